@@ -1,17 +1,25 @@
 
+# OPERATOR_PUBKEY is the base64 libp2p public key trusted to sign the remote config,
+# a build without it rejects every remote config and report server response
+if [ -z "${OPERATOR_PUBKEY}" ]; then
+    echo "OPERATOR_PUBKEY is not set" >&2
+    exit 1
+fi
+LDFLAGS="-X ipfs-monitor/config.OperatorPubKey=${OPERATOR_PUBKEY}"
+
 rm -rf ./out
 mkdir out
 mkdir ./out/amd64
 mkdir ./out/amd64/windows
-CGO_ENABLED=0 GOOS=windows GOARCH=amd64 go build  -o  ./out/amd64/windows/ipfs-monitor.exe
+CGO_ENABLED=0 GOOS=windows GOARCH=amd64 go build -ldflags "$LDFLAGS" -o  ./out/amd64/windows/ipfs-monitor.exe
 
 mkdir ./out/amd64/linux
-CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o  ./out/amd64/linux/ipfs-monitor
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS" -o  ./out/amd64/linux/ipfs-monitor
 
 mkdir ./out/amd64/darwin
-CGO_ENABLED=0 GOOS=darwin GOARCH=amd64 go build -o  ./out/amd64/darwin/ipfs-monitor
+CGO_ENABLED=0 GOOS=darwin GOARCH=amd64 go build -ldflags "$LDFLAGS" -o  ./out/amd64/darwin/ipfs-monitor
 
 mkdir ./out/arm64
 
 mkdir ./out/arm64/linux
-CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -o  ./out/arm64/linux/ipfs-monitor
\ No newline at end of file
+CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -ldflags "$LDFLAGS" -o  ./out/arm64/linux/ipfs-monitor
\ No newline at end of file
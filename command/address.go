@@ -0,0 +1,105 @@
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultAddress is used when no API address is configured and the IPFS repo
+// has no `api` file
+const DefaultAddress = "http://127.0.0.1:5001"
+
+// unixHost stands in for the host of requests sent over a unix socket
+const unixHost = "unix"
+
+// ResolveAddress turns an IPFS API address into the base URL of its HTTP
+// requests and, for unix sockets, the socket path to dial. The address is one
+// of
+//
+//	http://127.0.0.1:5001           an HTTP(S) URL, user info is dropped
+//	unix:///var/run/ipfs/api.sock   a unix socket path
+//	/ip4/127.0.0.1/tcp/5001         a multiaddr, as found in the repo's api file
+//	""                              discovered from $IPFS_PATH/api or ~/.ipfs/api
+func ResolveAddress(addr string) (baseURL string, socket string, err error) {
+	if addr == "" {
+		if addr, err = discoverAddress(); err != nil {
+			return "", "", err
+		}
+	}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		socket = strings.TrimPrefix(addr, "unix://")
+		if socket == "" {
+			return "", "", fmt.Errorf("Invalid IPFS API address %q: empty socket path", addr)
+		}
+		return "http://" + unixHost, socket, nil
+	case strings.HasPrefix(addr, "/"):
+		return parseMultiaddr(addr)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid IPFS API address %q: %s", addr, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", fmt.Errorf("Invalid IPFS API address %q: not an http(s) URL, unix:// path or multiaddr", addr)
+	}
+	u.User = nil
+	return strings.TrimRight(u.String(), "/"), "", nil
+}
+
+// parseMultiaddr supports the multiaddrs go-ipfs writes for its API:
+// /ip4|ip6|dns|dns4|dns6/<host>/tcp/<port> with an optional /http or /https
+// suffix, and /unix/<path>
+func parseMultiaddr(addr string) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(addr, "/"), "/")
+	if parts[0] == "unix" && len(parts) > 1 {
+		return "http://" + unixHost, "/" + strings.Join(parts[1:], "/"), nil
+	}
+	if len(parts) < 4 || parts[2] != "tcp" {
+		return "", "", fmt.Errorf("Invalid IPFS API address %q: unsupported multiaddr", addr)
+	}
+	host := parts[1]
+	switch parts[0] {
+	case "ip4", "ip6":
+		if net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("Invalid IPFS API address %q: bad IP %s", addr, host)
+		}
+	case "dns", "dns4", "dns6":
+	default:
+		return "", "", fmt.Errorf("Invalid IPFS API address %q: unsupported protocol %s", addr, parts[0])
+	}
+	scheme := "http"
+	if len(parts) > 4 {
+		if len(parts) != 5 || (parts[4] != "http" && parts[4] != "https") {
+			return "", "", fmt.Errorf("Invalid IPFS API address %q: unsupported multiaddr", addr)
+		}
+		scheme = parts[4]
+	}
+	return scheme + "://" + net.JoinHostPort(host, parts[3]), "", nil
+}
+
+// discoverAddress reads the API multiaddr from the `api` file the IPFS daemon
+// writes into its repo, like the ipfs CLI does
+func discoverAddress() (string, error) {
+	repo := os.Getenv("IPFS_PATH")
+	if repo == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return DefaultAddress, nil
+		}
+		repo = filepath.Join(home, ".ipfs")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(repo, "api"))
+	if os.IsNotExist(err) {
+		return DefaultAddress, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,99 @@
+package command
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// authorization turns a credential in the format of Kubo's
+// API.Authorizations AuthSecret, "basic:<user>:<password>" or
+// "bearer:<token>", into an Authorization header value
+func authorization(secret string) (string, error) {
+	parts := strings.SplitN(secret, ":", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		switch strings.ToLower(parts[0]) {
+		case "basic":
+			if !strings.Contains(parts[1], ":") {
+				return "", fmt.Errorf("basic credential must be basic:<user>:<password>")
+			}
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(parts[1])), nil
+		case "bearer":
+			return "Bearer " + parts[1], nil
+		}
+	}
+	return "", fmt.Errorf("credential must be basic:<user>:<password> or bearer:<token>")
+}
+
+// CheckAuth tells whether secret is a valid credential for SetAuth
+func CheckAuth(secret string) error {
+	_, err := authorization(secret)
+	return err
+}
+
+// SetAuth sends secret, "basic:<user>:<password>" or "bearer:<token>", with
+// every request. An empty secret falls back to the user info of the address.
+func (c *Client) SetAuth(secret string) error {
+	header := ""
+	if secret != "" {
+		var err error
+		if header, err = authorization(secret); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	c.auth = header
+	c.lock.Unlock()
+	return nil
+}
+
+// SetAuthFile reads credentials from path and uses the one for the current
+// address. Every line holds a credential, optionally preceded by the address
+// it is for; a credential without address is used for any other address.
+// Empty lines and lines starting with # are skipped.
+func (c *Client) SetAuthFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	c.lock.RLock()
+	baseURL, socket := c.baseURL, c.socket
+	c.lock.RUnlock()
+	var fallback, secret string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch len(fields) {
+		case 1:
+			if fallback == "" {
+				fallback = fields[0]
+			}
+		case 2:
+			entryURL, entrySocket, err := ResolveAddress(fields[0])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			if secret == "" && entryURL == baseURL && entrySocket == socket {
+				secret = fields[1]
+			}
+		default:
+			return fmt.Errorf("%s:%d: expect [address] credential", path, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if secret == "" {
+		secret = fallback
+	}
+	if err := c.SetAuth(secret); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		secret string
+		header string
+		err    bool
+	}{
+		{secret: "basic:alice:secret", header: "Basic YWxpY2U6c2VjcmV0"},
+		{secret: "Basic:alice:pa:ss", header: "Basic YWxpY2U6cGE6c3M="},
+		{secret: "bearer:token", header: "Bearer token"},
+		{secret: "BEARER:token", header: "Bearer token"},
+		{secret: "basic:alice", err: true},
+		{secret: "bearer:", err: true},
+		{secret: "token", err: true},
+		{secret: "digest:alice:secret", err: true},
+		{secret: "", err: true},
+	}
+	for _, test := range tests {
+		header, err := authorization(test.secret)
+		if test.err {
+			if err == nil {
+				t.Errorf("authorization(%q) = %q, want error", test.secret, header)
+			}
+			continue
+		}
+		if err != nil || header != test.header {
+			t.Errorf("authorization(%q) = %q, %v, want %q", test.secret, header, err, test.header)
+		}
+	}
+}
+
+func TestSetAuthFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "ipfs-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# credentials\n\nbearer:fallback\n/ip4/127.0.0.1/tcp/5001 bearer:local\nhttp://10.0.0.1:5001 basic:a:b\n")
+	file.Close()
+
+	tests := []struct {
+		addr   string
+		header string
+	}{
+		{"http://127.0.0.1:5001", "Bearer local"},
+		{"/ip4/10.0.0.1/tcp/5001", "Basic YTpi"},
+		{"http://10.0.0.2:5001", "Bearer fallback"},
+	}
+	for _, test := range tests {
+		c, err := NewClient(test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetAuthFile(file.Name()); err != nil {
+			t.Errorf("SetAuthFile for %s failed: %s", test.addr, err)
+			continue
+		}
+		if c.auth != test.header {
+			t.Errorf("SetAuthFile for %s set %q, want %q", test.addr, c.auth, test.header)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package command
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Client talks to the HTTP API of one IPFS node
+type Client struct {
+	lock          sync.RWMutex
+	baseURL       string
+	socket        string
+	auth          string
+	urlAuth       string
+	timeout       time.Duration
+	streamTimeout time.Duration
+	version       *Version
+	breaker       *breaker
+
+	// Retry is the policy for idempotent calls
+	Retry RetryPolicy
+	// HTTPClient sends every request, replace it to use another transport
+	HTTPClient *http.Client
+	// Headers are added to every request
+	Headers http.Header
+}
+
+// NewClient creates a client for the IPFS API at addr, see ResolveAddress for
+// the accepted forms. It waits 1 minute for response headers, aborts
+// pins without progress for 3 minutes and considers the node down for 30
+// seconds after 3 consecutive failures.
+func NewClient(addr string) (*Client, error) {
+	c := &Client{
+		timeout:       1 * time.Minute,
+		streamTimeout: 3 * time.Minute,
+		breaker:       &breaker{threshold: 3, cooldown: 30 * time.Second},
+		Retry:         DefaultRetryPolicy,
+		Headers:       make(http.Header),
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c.lock.RLock()
+		socket := c.socket
+		c.lock.RUnlock()
+		if socket != "" {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+	if err := c.SetBaseURL(addr); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetBaseURL switches the IPFS API used by later calls to addr, see
+// ResolveAddress for the accepted forms. User info of an HTTP(S) URL is sent
+// as basic auth unless SetAuth gives a credential. Calls in progress keep
+// their connection. An empty addr reads the repo's api file again, so a
+// restarted node on another port is found on the next SetBaseURL, e.g. a
+// config reload.
+func (c *Client) SetBaseURL(addr string) error {
+	baseURL, socket, err := ResolveAddress(addr)
+	if err != nil {
+		return err
+	}
+	urlAuth := ""
+	if u, err := url.Parse(addr); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		urlAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.urlAuth = urlAuth
+	if baseURL != c.baseURL || socket != c.socket {
+		c.baseURL = baseURL
+		c.socket = socket
+		c.version = nil
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// BaseURL returns the base URL of IPFS API, unix sockets have the host "unix"
+func (c *Client) BaseURL() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.baseURL
+}
+
+// SetTimeouts sets how long to wait for response headers and how long a
+// pin may go without progress
+func (c *Client) SetTimeouts(timeout time.Duration, streamTimeout time.Duration) {
+	c.lock.Lock()
+	c.timeout = timeout
+	c.streamTimeout = streamTimeout
+	c.lock.Unlock()
+}
+
+// Timeouts returns the timeouts set by SetTimeouts
+func (c *Client) Timeouts() (timeout time.Duration, streamTimeout time.Duration) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.timeout, c.streamTimeout
+}
+
+// post calls cmd of the IPFS RPC API (e.g. "pin/add") with args as query
+// parameters, the only encoding the RPC API accepts. The response headers have
+// to arrive within the client timeout.
+func (c *Client) post(ctx context.Context, cmd string, args url.Values) (*http.Response, error) {
+	if !c.breaker.allow() {
+		return nil, ErrNodeDown
+	}
+	timeout, _ := c.Timeouts()
+	ctx, cancel := context.WithCancel(ctx)
+	endpoint := c.BaseURL() + "/api/v0/" + cmd
+	if len(args) > 0 {
+		endpoint += "?" + args.Encode()
+	}
+	request, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	for key, values := range c.Headers {
+		request.Header[key] = values
+	}
+	if auth := c.authorization(); auth != "" {
+		request.Header.Set("Authorization", auth)
+	}
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := c.HTTPClient.Do(request)
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+			err = context.DeadlineExceeded
+		}
+		err = timeoutError{err}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+func (c *Client) authorization() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.auth != "" {
+		return c.auth
+	}
+	return c.urlAuth
+}
+
+// timeoutError is returned when the response headers did not arrive in time
+type timeoutError struct {
+	err error
+}
+
+func (e timeoutError) Error() string   { return "time out: " + e.err.Error() }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+func (e timeoutError) Unwrap() error   { return e.err }
+
+// call posts cmd and decodes the JSON response into result, op names the
+// call in errors
+func (c *Client) call(ctx context.Context, op string, cmd string, args url.Values, result interface{}) error {
+	resp, err := c.post(ctx, cmd, args)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(op, resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// cancelBody releases the request context once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
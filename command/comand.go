@@ -1,26 +1,71 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"ipfs-monitor/config"
 	"net/http"
-	"strconv"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/disk"
 )
 
-var Base_URL string
-var FailList []FailItem
-var httpStreamTimeout = config.GetHTTPStreamTimeout()
+// failList holds the failures recorded since they were last taken, guarded by
+// failLock
+var failList []FailItem
+var failLock sync.Mutex
+
+// AddFailure records a failure for the next report
+func AddFailure(item FailItem) {
+	failLock.Lock()
+	failList = append(failList, item)
+	failLock.Unlock()
+}
+
+// TakeFailures removes and returns the failures recorded so far, oldest first
+func TakeFailures() []FailItem {
+	failLock.Lock()
+	defer failLock.Unlock()
+	failures := failList
+	failList = nil
+	return failures
+}
 
 // Faliure history
 type FailItem struct {
-	Hash   string
-	Code   int
-	Detail string
+	Hash     string
+	Code     int
+	Detail   string
+	Attempts int
+}
+
+// Codes of FailItem
+const (
+	FailTimeout    = 1
+	FailInvalidCID = 2
+	FailUnpin      = 3
+	FailGC         = 4
+	FailDeadline   = 5
+	FailConnection = 6
+	FailNode       = 7
+	FailNoSpace    = 8
+)
+
+// FailCode is the FailItem code of a pin failing with err
+func FailCode(err error) int {
+	switch Classify(err) {
+	case ErrTimeout:
+		return FailTimeout
+	case ErrConnection:
+		return FailConnection
+	}
+	return FailNode
 }
 
 // ID struct for command `ipfs id`
@@ -37,6 +82,21 @@ type PinedList struct {
 	Keys map[string]interface{}
 }
 
+// PinedItem struct for command `ipfs pin ls --stream`
+type PinedItem struct {
+	Cid  string
+	Type string
+}
+
+// FilesStat struct for command `ipfs files stat`
+type FilesStat struct {
+	Hash           string
+	Size           uint64
+	CumulativeSize uint64
+	Blocks         int
+	Type           string
+}
+
 // ObjectItem nested struct for command `ipfs object get`
 type ObjectItem struct {
 	Name string
@@ -67,6 +127,12 @@ type RepoStat struct {
 	Version    string
 }
 
+// GCResult struct for command `ipfs repo gc`, one per removed block or error
+type GCResult struct {
+	Key   map[string]string
+	Error string
+}
+
 //Pined result struct for command `ipfs pin add`
 type PinedResult struct {
 	Pins     []string
@@ -74,124 +140,207 @@ type PinedResult struct {
 }
 
 // GetPeerID used for get IPFS peer ID
-func GetPeerID() (string, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/id")
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Get peer id failed: %s", resp.Status)
-	}
+func (c *Client) GetPeerID(ctx context.Context) (string, error) {
 	var result ID
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err := c.retry(ctx, func() error {
+		return c.call(ctx, "Get peer id", "id", nil, &result)
+	})
+	if err != nil {
 		return "", err
 	}
 	return result.ID, nil
 }
 
-// GetPeerID used for get IPFS peer ID
-func GetPubKey() (string, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/id")
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Get peer id failed: %s", resp.Status)
-	}
+// GetPubKey used for get public key of IPFS peer
+func (c *Client) GetPubKey(ctx context.Context) (string, error) {
 	var result ID
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err := c.retry(ctx, func() error {
+		return c.call(ctx, "Get peer id", "id", nil, &result)
+	})
+	if err != nil {
 		return "", err
 	}
 	return result.PublicKey, nil
 }
 
-// GetPinedList used for get pined file list
-func GetPinedList() ([]string, map[string]uint64, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/pin/ls?type=recursive")
+// SizeLookups is the number of sizes GetPinedList calculates concurrently
+var SizeLookups = 8
+
+// GetPinedList streams the pined file list to fn in pages of up to pageSize
+// CIDs, the last page (possibly empty) is marked by last. sizes holds the
+// sizes known before and contains the sizes of every page when fn is called.
+// After the last page the sizes of removed pins are deleted. The sizes
+// calculated before an error are kept. CIDs whose size cannot be calculated
+// are missing from sizes and tried again on the next call.
+func (c *Client) GetPinedList(ctx context.Context, sizes map[string]Size, pageSize int, fn func(keys []string, last bool) error) error {
+	pinned := make(map[string]bool, len(sizes))
+	var page []string
+	flush := func(last bool) error {
+		if err := c.calculateSizes(ctx, sizes, page); err != nil {
+			return err
+		}
+		if err := fn(page, last); err != nil {
+			return err
+		}
+		page = nil
+		return nil
+	}
+	err := c.pinnedKeys(ctx, func(key string) error {
+		if pinned[key] {
+			return nil
+		}
+		pinned[key] = true
+		if len(page) >= pageSize {
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+		page = append(page, key)
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("Get pined files failed: %s", resp.Status)
+	if err := flush(true); err != nil {
+		return err
 	}
-	var result PinedList
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, nil, err
+	for key := range sizes {
+		if !pinned[key] {
+			delete(sizes, key)
+		}
 	}
-	keys := make([]string, len(result.Keys))
-	items := make(map[string]uint64)
-	i := 0
-	for key := range result.Keys {
-		size, err := calculateRootSpace(key)
-		if err != nil {
-			return nil, nil, err
+	return nil
+}
+
+// calculateSizes adds the sizes of keys missing from sizes, up to SizeLookups
+// at a time. A key whose size the node fails to calculate while it is up is
+// left out of sizes, only a failure of the node ends the calculation.
+func (c *Client) calculateSizes(ctx context.Context, sizes map[string]Size, keys []string) error {
+	var missing []string
+	for _, key := range keys {
+		if _, ok := sizes[key]; !ok {
+			missing = append(missing, key)
 		}
-		//items[i] = reporter.Item{ID: k, Size: size}
-		keys[i] = key
-		items[key] = size
-		i++
 	}
-	return keys, items, nil
-}
-
-// func GetPinedSpace(pinedList []string) (uint64, error) {
-// 	var space uint64
-// 	for _, hash := range pinedList {
-// 		rootSpace, err := calculateRootSpace(hash)
-// 		if err != nil {
-// 			return 0, err
-// 		}
-// 		space += rootSpace
-// 	}
-// 	return space, nil
-// }
-
-func calculateRootSpace(hash string) (uint64, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/object/get?arg=" + hash)
-	if err != nil {
-		return 0, err
+	workers := SizeLookups
+	if workers > len(missing) {
+		workers = len(missing)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Calculate space for file %s failed: %s", hash, resp.Status)
+	if workers < 1 {
+		return nil
 	}
-	var result Object
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var lock sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				var size Size
+				err := c.retry(ctx, func() (err error) {
+					size, err = c.GetSize(ctx, key)
+					return err
+				})
+				lock.Lock()
+				if err == nil {
+					sizes[key] = size
+				} else if Classify(err) != ErrOther && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				lock.Unlock()
+			}
+		}()
 	}
-	var space uint64
-	for _, item := range result.Links {
-		space += item.Size
+dispatch:
+	for _, key := range missing {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+			break dispatch
+		}
 	}
-	if space == 0 {
-		space = uint64(len(result.Data))
+	close(jobs)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
 	}
-	return space, nil
+	return firstErr
 }
 
-// GetThroughput used for get throughput
-func GetThroughput() (uint64, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/stats/bw")
+// pinnedKeys passes the recursively pinned CIDs to fn, streamed one JSON
+// object per line on nodes supporting it. Only the request is retried, an
+// error in the middle of the list ends it.
+func (c *Client) pinnedKeys(ctx context.Context, fn func(key string) error) error {
+	version, err := c.Version(ctx)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if !version.supportsPinStream() {
+		var result PinedList
+		err := c.retry(ctx, func() error {
+			return c.call(ctx, "Get pined files", "pin/ls", url.Values{"type": {"recursive"}}, &result)
+		})
+		if err != nil {
+			return err
+		}
+		for key := range result.Keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var resp *http.Response
+	err = c.retry(ctx, func() (err error) {
+		resp, err = c.post(ctx, "pin/ls", url.Values{"type": {"recursive"}, "stream": {"true"}})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError("Get pined files", resp)
+			resp.Body.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Get throughput failed: %s", resp.Status)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var item PinedItem
+		if err := decoder.Decode(&item); err == io.EOF {
+			return streamError(resp)
+		} else if err != nil {
+			return err
+		}
+		if err := fn(item.Cid); err != nil {
+			return err
+		}
 	}
+}
+
+// GetThroughput used for get throughput
+func (c *Client) GetThroughput(ctx context.Context) (uint64, error) {
 	var result Bandwidth
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err := c.retry(ctx, func() error {
+		return c.call(ctx, "Get throughput", "stats/bw", nil, &result)
+	})
+	if err != nil {
 		return 0, err
 	}
 	return result.Totalout, nil
 }
 
 // GetFreeSpace used for get free space of repo disk
-func GetFreeSpace() (uint64, error) {
-	path, err := GetRepoPath()
+func (c *Client) GetFreeSpace(ctx context.Context) (uint64, error) {
+	path, err := c.GetRepoPath(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -208,74 +357,164 @@ func GetFreeSpace() (uint64, error) {
 	// return fs.Bavail * uint64(fs.Bsize), nil
 }
 
-func GetRepoPath() (string, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/repo/stat")
+func (c *Client) GetRepoPath(ctx context.Context) (string, error) {
+	stat, err := c.GetRepoStat(ctx)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Get repo stat failed: %s", resp.Status)
-	}
+	return stat.RepoPath, nil
+}
+
+// GetRepoStat used for get size, size limit and path of repo
+func (c *Client) GetRepoStat(ctx context.Context) (*RepoStat, error) {
 	var result RepoStat
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+	err := c.retry(ctx, func() error {
+		return c.call(ctx, "Get repo stat", "repo/stat", nil, &result)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return result.RepoPath, nil
+	return &result, nil
 }
 
-func GetFile(hash string, dst io.Writer, progress func(int64, int64)) error {
-	resp, err := http.Get(Base_URL + "/api/v0/get?arg=" + hash)
+// pinEvent is one object of the `ipfs pin add --progress` stream, the last
+// one holds Pins. A failing pin ends with an object of Type "error" or the
+// X-Stream-Error trailer.
+type pinEvent struct {
+	Pins     []string
+	Progress uint64
+	Message  string
+	Type     string
+}
+
+// PinFile pins the file of hash recursively, fetching the blocks missing
+// from the node. progress, if not nil, is called with the number of blocks
+// fetched so far whenever it grows. The pin fails with a timeout error when no
+// block arrives within the stream timeout.
+func (c *Client) PinFile(ctx context.Context, hash string, progress func(blocks uint64)) (*PinedResult, error) {
+	resp, err := c.post(ctx, "pin/add", url.Values{"arg": {hash}, "recursive": {"true"}, "progress": {"true"}})
 	if err != nil {
-		item := FailItem{hash, 1, "time out"}
-		FailList = append(FailList, item)
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	timer := time.AfterFunc(httpStreamTimeout, func() {
-		resp.Body.Close()
-		item := FailItem{hash, 1, "time out"}
-		FailList = append(FailList, item)
-	})
-	fileSizeStr := resp.Header.Get("X-Content-Length")
-	if fileSizeStr == "" {
-		fileSizeStr = "-1"
-	}
-	fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-	if err != nil {
-		fileSize = -1
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("Pin file "+hash, resp)
 	}
-	var downloadSize int64
+	_, httpStreamTimeout := c.Timeouts()
+	stall := newStallTimer(resp.Body, httpStreamTimeout)
+	defer stall.stop()
+	var result PinedResult
+	decoder := json.NewDecoder(resp.Body)
 	for {
-		written, err := io.CopyN(dst, resp.Body, 128*1024)
-		if progress != nil {
-			timer.Reset(httpStreamTimeout)
-			downloadSize += written
-			progress(downloadSize, fileSize)
+		var event pinEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			break
+		} else if stall.stalled() {
+			return nil, timeoutError{fmt.Errorf("no block of %s within %s", hash, httpStreamTimeout)}
+		} else if err != nil {
+			return nil, err
 		}
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return err
+		if event.Type == "error" {
+			return nil, errors.New(event.Message)
+		}
+		// the node repeats the count every half second, only a grown count
+		// is progress
+		if event.Progress > result.Progress {
+			result.Progress = event.Progress
+			stall.reset()
+			if progress != nil {
+				progress(result.Progress)
 			}
 		}
+		if event.Pins != nil {
+			result.Pins = event.Pins
+			return &result, nil
+		}
+	}
+	if err := streamError(resp); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("pin of %s ended without result", hash)
+}
+
+// streamError returns the error the node sent in the X-Stream-Error trailer
+// of a streamed response cut short, the trailer is only known once the body
+// is read to its end
+func streamError(resp *http.Response) error {
+	if message := resp.Trailer.Get("X-Stream-Error"); message != "" {
+		return errors.New(message)
 	}
 	return nil
 }
 
-func PinFile(hash string) (*PinedResult, error) {
-	resp, err := http.Get(Base_URL + "/api/v0/pin/add?arg=" + hash + "&recursive=true&progress=false")
+// stallTimer closes a response body that makes no progress within timeout
+type stallTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	fired   int32
+}
+
+func newStallTimer(body io.Closer, timeout time.Duration) *stallTimer {
+	s := &stallTimer{timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&s.fired, 1)
+		body.Close()
+	})
+	return s
+}
+
+// reset restarts the timeout after progress
+func (s *stallTimer) reset() {
+	s.timer.Reset(s.timeout)
+}
+
+func (s *stallTimer) stop() {
+	s.timer.Stop()
+}
+
+// stalled tells whether the body was closed for lack of progress
+func (s *stallTimer) stalled() bool {
+	return atomic.LoadInt32(&s.fired) == 1
+}
+
+// UnpinFile removes the recursive pin of hash
+func (c *Client) UnpinFile(ctx context.Context, hash string) error {
+	var result PinedResult
+	return c.call(ctx, "Unpin file "+hash, "pin/rm", url.Values{"arg": {hash}, "recursive": {"true"}}, &result)
+}
+
+// RepoGC runs the garbage collection of the repo and returns the number of
+// removed blocks, errors of single blocks are joined into the returned error
+func (c *Client) RepoGC(ctx context.Context) (int, error) {
+	resp, err := c.post(ctx, "repo/gc", url.Values{"stream-errors": {"true"}})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Pin file stat failed: %s", resp.Status)
+		return 0, statusError("Repo gc", resp)
 	}
-	var result PinedResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	var removed int
+	var errs []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var result GCResult
+		if err := decoder.Decode(&result); err == io.EOF {
+			if err := streamError(resp); err != nil {
+				errs = append(errs, err.Error())
+			}
+			break
+		} else if err != nil {
+			return removed, err
+		}
+		if result.Error != "" {
+			errs = append(errs, result.Error)
+		} else {
+			removed++
+		}
 	}
-	return &result, nil
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("Repo gc failed: %s", strings.Join(errs, "; "))
+	}
+	return removed, nil
 }
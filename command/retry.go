@@ -0,0 +1,201 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNodeDown is returned without contacting the node while the circuit
+// breaker is open
+var ErrNodeDown = errors.New("IPFS node is down")
+
+// ErrorKind classifies a failed API call
+type ErrorKind int
+
+const (
+	// ErrOther is a failure retrying cannot fix, e.g. a bad request or an
+	// undecodable response
+	ErrOther ErrorKind = iota
+	// ErrConnection means the node could not be reached, e.g. connection refused
+	ErrConnection
+	// ErrTimeout means the node did not answer in time
+	ErrTimeout
+	// ErrServer means the node or a proxy in front of it is unavailable, it
+	// answered with 502, 503 or 504. Other statuses, including the 500 the node
+	// answers failed commands with, are ErrOther.
+	ErrServer
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrConnection:
+		return "connection"
+	case ErrTimeout:
+		return "timeout"
+	case ErrServer:
+		return "server"
+	}
+	return "other"
+}
+
+// maxErrorBody bounds the part of an error response decoded for its message
+const maxErrorBody = 4096
+
+// StatusError is returned when the node answers with a non-200 status,
+// Message is the message of the error object in the response, if any
+type StatusError struct {
+	Op      string
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s failed: %s: %s", e.Op, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Op, e.Status)
+}
+
+// statusError reads the error object the node answers failed commands with,
+// {"Message": ..., "Code": ..., "Type": "error"}, from the non-200 resp
+func statusError(op string, resp *http.Response) *StatusError {
+	err := &StatusError{Op: op, Code: resp.StatusCode, Status: resp.Status}
+	var body struct {
+		Message string
+		Type    string
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&body) == nil && body.Type == "error" {
+		err.Message = body.Message
+	}
+	return err
+}
+
+// Classify tells what kind of failure err is
+func Classify(err error) ErrorKind {
+	var statusErr *StatusError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return ErrOther
+	case err == ErrNodeDown:
+		return ErrConnection
+	case errors.As(err, &statusErr):
+		switch statusErr.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return ErrServer
+		}
+		return ErrOther
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ENOENT), errors.As(err, &opErr):
+		return ErrConnection
+	}
+	return ErrOther
+}
+
+// RetryPolicy tells how often and how fast idempotent calls are retried
+type RetryPolicy struct {
+	// Attempts is the number of tries, 1 disables retries
+	Attempts int
+	// BaseDelay is the upper bound of the first delay, it doubles with every
+	// retry up to MaxDelay and the actual delay is picked at random below it
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created by NewClient
+var DefaultRetryPolicy = RetryPolicy{Attempts: 4, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// Delay picks the delay before retry number retry, counting from 0
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	d := p.BaseDelay << uint(retry)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// breaker marks the node down after threshold consecutive connection, timeout
+// or server failures of idempotent calls. While down every call fails with
+// ErrNodeDown, after cooldown calls are let through again and the next
+// result decides.
+type breaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures < b.threshold || !time.Now().Before(b.openUntil)
+}
+
+func (b *breaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil || Classify(err) == ErrOther {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+func (b *breaker) down() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures >= b.threshold
+}
+
+// Down tells whether the circuit breaker considers the node down, it is up
+// again after the first successful call
+func (c *Client) Down() bool {
+	return c.breaker.down()
+}
+
+// retry runs the idempotent call fn under the retry policy, retrying
+// connection, timeout and server failures
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < c.Retry.Attempts || attempt == 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.Retry.Delay(attempt - 1)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		if !c.breaker.allow() && err != nil {
+			return err
+		}
+		err = fn()
+		if err == ErrNodeDown {
+			return err
+		}
+		c.breaker.record(err)
+		if err == nil || Classify(err) == ErrOther {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{nil, ErrOther},
+		{ErrNodeDown, ErrConnection},
+		{&StatusError{Code: 500, Message: "merkledag: not found"}, ErrOther},
+		{&StatusError{Code: 500}, ErrOther},
+		{&StatusError{Code: 400}, ErrOther},
+		{&StatusError{Code: 502}, ErrServer},
+		{&StatusError{Code: 503}, ErrServer},
+		{&StatusError{Code: 504}, ErrServer},
+		{fmt.Errorf("calculate size: %w", &StatusError{Code: 503}), ErrServer},
+		{context.DeadlineExceeded, ErrTimeout},
+		{timeoutError{errors.New("no response headers")}, ErrTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, ErrConnection},
+		{&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}, ErrConnection},
+		{context.Canceled, ErrOther},
+		{errors.New("invalid character"), ErrOther},
+	}
+	for _, test := range tests {
+		if kind := Classify(test.err); kind != test.kind {
+			t.Errorf("Classify(%v) = %s, want %s", test.err, kind, test.kind)
+		}
+	}
+}
+
+func TestStatusErrorMessage(t *testing.T) {
+	tests := []struct {
+		body    string
+		message string
+	}{
+		{`{"Message":"merkledag: not found","Code":0,"Type":"error"}`, "merkledag: not found"},
+		{`<html>Bad Gateway</html>`, ""},
+		{`{"Message":"not an error object"}`, ""},
+		{``, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		recorder.WriteHeader(http.StatusInternalServerError)
+		recorder.WriteString(test.body)
+		err := statusError("Get peer id", recorder.Result())
+		if err.Code != 500 || err.Message != test.message {
+			t.Errorf("statusError(%q) = %d %q, want 500 %q", test.body, err.Code, err.Message, test.message)
+		}
+		if test.message != "" && !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%q does not carry the message %q", err.Error(), test.message)
+		}
+	}
+}
+
+// flakyNode answers `id` with the statuses in answers, one per request, and
+// 200 once they are used up
+type flakyNode struct {
+	lock    sync.Mutex
+	answers []int
+	calls   int
+}
+
+func (n *flakyNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.lock.Lock()
+	n.calls++
+	status := http.StatusOK
+	if len(n.answers) > 0 {
+		status, n.answers = n.answers[0], n.answers[1:]
+	}
+	n.lock.Unlock()
+	if status == http.StatusInternalServerError {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"Message":"some command error","Code":0,"Type":"error"}`)
+		return
+	}
+	w.WriteHeader(status)
+	fmt.Fprint(w, `{"ID":"QmPeer"}`)
+}
+
+func (n *flakyNode) answer(statuses ...int) {
+	n.lock.Lock()
+	n.answers = statuses
+	n.calls = 0
+	n.lock.Unlock()
+}
+
+func (n *flakyNode) called() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.calls
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		answers  []int
+		calls    int
+		err      bool
+		down     bool
+	}{
+		{"success", 4, nil, 1, false, false},
+		{"unavailable then success", 4, []int{503, 502}, 3, false, false},
+		{"unavailable every attempt", 4, []int{503, 503, 503, 503}, 3, true, true},
+		{"command error is not retried", 4, []int{500, 500}, 1, true, false},
+		{"client error is not retried", 4, []int{404, 404}, 1, true, false},
+		{"retries disabled", 1, []int{503}, 1, true, false},
+	}
+	node := &flakyNode{}
+	c, stop := newFakeClient(t, node)
+	defer stop()
+	for _, test := range tests {
+		c.breaker = &breaker{threshold: 3, cooldown: time.Minute}
+		c.Retry.Attempts = test.attempts
+		node.answer(test.answers...)
+		_, err := c.GetPeerID(context.Background())
+		if (err != nil) != test.err {
+			t.Errorf("%s: GetPeerID error %v, want error %v", test.name, err, test.err)
+		}
+		if calls := node.called(); calls != test.calls {
+			t.Errorf("%s: node called %d times, want %d", test.name, calls, test.calls)
+		}
+		if c.Down() != test.down {
+			t.Errorf("%s: Down() = %v, want %v", test.name, c.Down(), test.down)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	node := &flakyNode{}
+	c, stop := newFakeClient(t, node)
+	defer stop()
+	c.Retry.Attempts = 1
+	c.breaker = &breaker{threshold: 3, cooldown: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	// failures that are not in a row do not open the breaker
+	node.answer(503, 503, 200, 503, 503)
+	for i := 0; i < 5; i++ {
+		c.GetPeerID(ctx)
+	}
+	if c.Down() {
+		t.Fatal("breaker opened without 3 failures in a row")
+	}
+
+	// command errors never open it
+	node.answer(500, 500, 500, 500)
+	for i := 0; i < 4; i++ {
+		c.GetPeerID(ctx)
+	}
+	if c.Down() {
+		t.Fatal("breaker opened by command errors")
+	}
+
+	node.answer(503, 503, 503)
+	for i := 0; i < 3; i++ {
+		c.GetPeerID(ctx)
+	}
+	if !c.Down() {
+		t.Fatal("breaker still closed after 3 failures in a row")
+	}
+	if _, err := c.GetPeerID(ctx); err != ErrNodeDown {
+		t.Errorf("GetPeerID while open = %v, want ErrNodeDown", err)
+	}
+	if calls := node.called(); calls != 3 {
+		t.Errorf("node called %d times, want 3, none while open", calls)
+	}
+
+	// after the cooldown one failure opens it again, one success closes it
+	time.Sleep(60 * time.Millisecond)
+	node.answer(503)
+	if _, err := c.GetPeerID(ctx); err == ErrNodeDown || err == nil {
+		t.Errorf("GetPeerID after cooldown = %v, want the node's failure", err)
+	}
+	if _, err := c.GetPeerID(ctx); err != ErrNodeDown {
+		t.Errorf("GetPeerID after a failure past the cooldown = %v, want ErrNodeDown", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.GetPeerID(ctx); err != nil {
+		t.Errorf("GetPeerID after cooldown failed: %s", err)
+	}
+	if c.Down() {
+		t.Error("breaker still open after a success")
+	}
+}
@@ -0,0 +1,152 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Size is the size of a pinned DAG
+type Size struct {
+	// Logical is the content size: the file size of UnixFS files and the
+	// cumulative size of UnixFS directories and other DAGs
+	Logical uint64 `json:"logical"`
+	// Disk is the total size of the blocks of the DAG
+	Disk uint64 `json:"disk"`
+}
+
+// BlockStat struct for command `ipfs block stat`
+type BlockStat struct {
+	Key  string
+	Size uint64
+}
+
+// DagStat struct for command `ipfs dag stat`, newer nodes report the stats
+// of every argument in DagStats and their sum in TotalSize
+type DagStat struct {
+	Size      uint64
+	NumBlocks int
+	TotalSize uint64
+	DagStats  []struct {
+		Cid       interface{}
+		Size      uint64
+		NumBlocks int
+	}
+}
+
+// GetSize calculates the size of the DAG of hash as its codec requires: a
+// raw block by `block stat`, UnixFS by `files stat` (or `object get` on nodes
+// without it) and any other codec by `dag stat`. dag-pb nodes that are no
+// UnixFS, which `files stat` rejects, are measured by `dag stat` too.
+func (c *Client) GetSize(ctx context.Context, hash string) (Size, error) {
+	id, err := cid.Decode(hash)
+	if err != nil {
+		return Size{}, fmt.Errorf("Invalid CID %s: %s", hash, err)
+	}
+	version, err := c.Version(ctx)
+	if err != nil {
+		return Size{}, err
+	}
+	op := "Calculate space for file " + hash
+	switch id.Prefix().Codec {
+	case cid.Raw:
+		var result BlockStat
+		if err := c.call(ctx, op, "block/stat", url.Values{"arg": {hash}}, &result); err != nil {
+			return Size{}, err
+		}
+		return Size{result.Size, result.Size}, nil
+	case cid.DagProtobuf:
+		size, err := c.unixfsSize(ctx, op, hash, version)
+		if rejected(err) {
+			return c.dagSize(ctx, op, hash)
+		}
+		return size, err
+	}
+	return c.dagSize(ctx, op, hash)
+}
+
+// unixfsSize tells the size of the UnixFS DAG of hash from its root, by
+// `files stat` or `object get` on nodes without it
+func (c *Client) unixfsSize(ctx context.Context, op string, hash string, version *Version) (Size, error) {
+	if !version.supportsFilesStat() {
+		return c.objectSize(ctx, op, hash)
+	}
+	var result FilesStat
+	if err := c.call(ctx, op, "files/stat", url.Values{"arg": {"/ipfs/" + hash}}, &result); err != nil {
+		return Size{}, err
+	}
+	if result.Type == "file" {
+		return Size{result.Size, result.CumulativeSize}, nil
+	}
+	return Size{result.CumulativeSize, result.CumulativeSize}, nil
+}
+
+// rejected tells whether err is the node refusing the command, e.g. `files
+// stat` of a dag-pb node that is no UnixFS, rather than the node failing
+func rejected(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && Classify(err) == ErrOther
+}
+
+// dagSize sums the sizes of the blocks of the DAG of hash with `dag stat`
+func (c *Client) dagSize(ctx context.Context, op string, hash string) (Size, error) {
+	var result DagStat
+	if err := c.call(ctx, op, "dag/stat", url.Values{"arg": {hash}, "progress": {"false"}}, &result); err != nil {
+		return Size{}, err
+	}
+	size := result.Size
+	if result.TotalSize > 0 {
+		size = result.TotalSize
+	}
+	return Size{size, size}, nil
+}
+
+// EstimateSize tells the size of the blocks of the DAG of hash from its root
+// block alone: the size of a raw block and the cumulative size of a UnixFS
+// root. known is false for other codecs and dag-pb nodes that are no UnixFS,
+// their size is only known once every block is fetched.
+func (c *Client) EstimateSize(ctx context.Context, hash string) (size uint64, known bool, err error) {
+	id, err := cid.Decode(hash)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid CID %s: %s", hash, err)
+	}
+	var s Size
+	switch id.Prefix().Codec {
+	case cid.Raw:
+		s, err = c.GetSize(ctx, hash)
+	case cid.DagProtobuf:
+		var version *Version
+		if version, err = c.Version(ctx); err == nil {
+			s, err = c.unixfsSize(ctx, "Estimate space for file "+hash, hash, version)
+		}
+		if rejected(err) {
+			return 0, false, nil
+		}
+	default:
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return s.Disk, true, nil
+}
+
+// objectSize sums the cumulative sizes of the root's links, the only size
+// `object get` knows, or the root's data when it has no links
+func (c *Client) objectSize(ctx context.Context, op string, hash string) (Size, error) {
+	var result Object
+	if err := c.call(ctx, op, "object/get", url.Values{"arg": {hash}}, &result); err != nil {
+		return Size{}, err
+	}
+	var space uint64
+	for _, item := range result.Links {
+		space += item.Size
+	}
+	if space == 0 {
+		space = uint64(len(result.Data))
+	}
+	return Size{space, space}, nil
+}
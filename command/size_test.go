@@ -0,0 +1,125 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode answers like go-ipfs 0.18: dag-pb nodes that are no UnixFS are
+// rejected by files/stat with a 500 error object
+type fakeNode struct {
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	arg := r.URL.Query().Get("arg")
+	n.lock.Lock()
+	n.calls[r.URL.Path+" "+arg]++
+	n.lock.Unlock()
+	fail := func(message string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"Message":%q,"Code":0,"Type":"error"}`, message)
+	}
+	switch r.URL.Path + " " + arg {
+	case "/api/v0/version ":
+		fmt.Fprint(w, `{"Version":"0.18.0"}`)
+	case "/api/v0/pin/ls ":
+		fmt.Fprint(w, `{"Cid":"QmFile","Type":"recursive"}`+"\n")
+		fmt.Fprint(w, `{"Cid":"QmObject","Type":"recursive"}`+"\n")
+		fmt.Fprint(w, `{"Cid":"QmBroken","Type":"recursive"}`+"\n")
+	case "/api/v0/files/stat /ipfs/QmFile":
+		fmt.Fprint(w, `{"Size":10,"CumulativeSize":20,"Type":"file"}`)
+	case "/api/v0/dag/stat QmObject":
+		fmt.Fprint(w, `{"Size":30,"NumBlocks":1}`)
+	case "/api/v0/files/stat /ipfs/QmObject", "/api/v0/files/stat /ipfs/QmBroken":
+		fail("unexpected node type")
+	default:
+		fail("block not found")
+	}
+}
+
+func newFakeClient(t *testing.T, handler http.Handler) (*Client, func()) {
+	server := httptest.NewServer(handler)
+	c, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retry = RetryPolicy{Attempts: 4, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	return c, server.Close
+}
+
+func TestGetSize(t *testing.T) {
+	node := &fakeNode{calls: make(map[string]int)}
+	c, stop := newFakeClient(t, node)
+	defer stop()
+	tests := []struct {
+		hash string
+		size Size
+		err  bool
+	}{
+		{hash: "QmFile", size: Size{10, 20}},
+		{hash: "QmObject", size: Size{30, 30}},
+		{hash: "QmBroken", err: true},
+	}
+	for _, test := range tests {
+		size, err := c.GetSize(context.Background(), test.hash)
+		if test.err {
+			if err == nil {
+				t.Errorf("GetSize(%s) = %v, want error", test.hash, size)
+			}
+			continue
+		}
+		if err != nil || size != test.size {
+			t.Errorf("GetSize(%s) = %v, %v, want %v", test.hash, size, err, test.size)
+		}
+	}
+}
+
+func TestEstimateSizeNotUnixFS(t *testing.T) {
+	node := &fakeNode{calls: make(map[string]int)}
+	c, stop := newFakeClient(t, node)
+	defer stop()
+	size, known, err := c.EstimateSize(context.Background(), "QmObject")
+	if err != nil || known {
+		t.Errorf("EstimateSize(QmObject) = %d, %v, %v, want unknown", size, known, err)
+	}
+	// dag/stat would fetch the whole DAG before the pin is admitted
+	if calls := node.calls["/api/v0/dag/stat QmObject"]; calls != 0 {
+		t.Errorf("EstimateSize called dag/stat %d times, want 0", calls)
+	}
+}
+
+func TestGetPinedListSizeFailure(t *testing.T) {
+	node := &fakeNode{calls: make(map[string]int)}
+	c, stop := newFakeClient(t, node)
+	defer stop()
+	sizes := make(map[string]Size)
+	var keys []string
+	err := c.GetPinedList(context.Background(), sizes, 10, func(page []string, last bool) error {
+		keys = append(keys, page...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GetPinedList failed: %s", err)
+	}
+	if want := []string{"QmFile", "QmObject", "QmBroken"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("GetPinedList listed %v, want %v", keys, want)
+	}
+	want := map[string]Size{"QmFile": {10, 20}, "QmObject": {30, 30}}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Errorf("sizes = %v, want %v", sizes, want)
+	}
+	if c.Down() {
+		t.Error("node considered down after a CID it cannot stat")
+	}
+	if calls := node.calls["/api/v0/dag/stat QmBroken"]; calls != 1 {
+		t.Errorf("dag/stat of QmBroken called %d times, want 1", calls)
+	}
+}
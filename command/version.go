@@ -0,0 +1,61 @@
+package command
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Version struct for command `ipfs version`
+type Version struct {
+	Version string
+	Commit  string
+	Repo    string
+	System  string
+	Golang  string
+}
+
+// AtLeast tells whether the node runs version major.minor.patch or newer,
+// pre-release suffixes like "-rc1" are ignored
+func (v *Version) AtLeast(major, minor, patch int) bool {
+	parts := strings.SplitN(strings.SplitN(v.Version, "-", 2)[0], ".", 3)
+	want := []int{major, minor, patch}
+	for i, w := range want {
+		var n int
+		if i < len(parts) {
+			n, _ = strconv.Atoi(parts[i])
+		}
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
+
+// Since go-ipfs 0.5.0 `pin ls` can stream its result and `files stat` gives
+// the size of any /ipfs path, older nodes only have `object get` for UnixFS
+// sizes
+func (v *Version) supportsPinStream() bool { return v.AtLeast(0, 5, 0) }
+func (v *Version) supportsFilesStat() bool { return v.AtLeast(0, 5, 0) }
+
+// Version asks the node for its version, the answer is cached until the base
+// URL changes
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	c.lock.RLock()
+	version := c.version
+	c.lock.RUnlock()
+	if version != nil {
+		return version, nil
+	}
+	var result Version
+	err := c.retry(ctx, func() error {
+		return c.call(ctx, "Get version", "version", nil, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.version = &result
+	c.lock.Unlock()
+	return &result, nil
+}
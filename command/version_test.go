@@ -0,0 +1,28 @@
+package command
+
+import "testing"
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version             string
+		major, minor, patch int
+		want                bool
+	}{
+		{"0.5.0", 0, 5, 0, true},
+		{"0.4.23", 0, 5, 0, false},
+		{"0.10.0", 0, 5, 0, true},
+		{"1.0.0", 0, 5, 0, true},
+		{"0.5.0-rc1", 0, 5, 0, true},
+		{"0.5", 0, 5, 0, true},
+		{"0.5", 0, 5, 1, false},
+		{"0.18.1-dev", 0, 18, 2, false},
+		{"", 0, 5, 0, false},
+		{"", 0, 0, 0, true},
+	}
+	for _, test := range tests {
+		v := &Version{Version: test.version}
+		if got := v.AtLeast(test.major, test.minor, test.patch); got != test.want {
+			t.Errorf("%q.AtLeast(%d, %d, %d) = %v, want %v", test.version, test.major, test.minor, test.patch, got, test.want)
+		}
+	}
+}
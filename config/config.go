@@ -1,64 +1,414 @@
 package config
 
 import (
+	"encoding"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 )
 
 type config struct {
-	BaseUrl           string `json:"baseUrl"`
-	ServerUrl         string `json:"serverUrl"`
-	CronExpr          string `json:"cronExpr"`
-	JobCount          int    `json:"jobCount"`
-	HTTPTimeout       string `json:"httpTimeout"`
-	HTTPStreamTimeout string `json:"httpStreamTimeout"`
+	BaseUrl            string   `json:"baseUrl" flag:"ipfs_base_url" usage:"Address of IPFS API: URL, unix:// socket path or multiaddr, empty to read $IPFS_PATH/api"`
+	ServerUrl          string   `json:"serverUrl" usage:"Server URL for reporting status"`
+	ServerPubKey       string   `json:"serverPubKey" usage:"Base64 libp2p public key the report server signs its responses with, empty to use the operator key"`
+	CronExpr           string   `json:"cronExpr" usage:"Cron expression for reporting IPFS node status regularly"`
+	JobCount           int      `json:"jobCount" usage:"Number of concurrent pinning jobs, 1 to 20"`
+	HTTPTimeout        Duration `json:"httpTimeout" usage:"Duration to wait for IPFS API response headers"`
+	HTTPStreamTimeout  Duration `json:"httpStreamTimeout" usage:"Duration without a fetched block before a pin is aborted"`
+	ReloadInterval     Duration `json:"reloadInterval" usage:"Duration between polls of the remote config, 0 disables polling"`
+	FullReportInterval Duration `json:"fullReportInterval" usage:"Duration between reports of the full pin list, reports in between carry changes only, 0 always reports the full list"`
+	SpaceMargin        int64    `json:"spaceMargin" usage:"Bytes to keep free on the repo disk, pins that do not fit besides them are rejected"`
+	IPFSAuth           string   `json:"ipfsAuth" secret:"true" usage:"Credential for IPFS API: basic:<user>:<password> or bearer:<token>"`
+	IPFSAuthFile       string   `json:"ipfsAuthFile" usage:"File of IPFS API credentials, one \"[address] credential\" per line"`
 }
 
-const configServer = "http://hash.iptokenmain.com/monitor/config.json"
+// Sources of configuration values, from lowest to highest precedence:
+// built-in defaults, local config file, remote config server (or the cached
+// copy of the last good one), environment variables and explicit overrides
+// (command-line flags).
+const (
+	SourceDefault     = "default"
+	SourceFile        = "file"
+	SourceRemote      = "remote"
+	SourceRemoteCache = "remote-cache"
+	SourceEnv         = "env"
+	SourceFlag        = "flag"
+)
+
+// ConfigFileEnv is the environment variable holding the path of the local
+// config file, used when no path is given on the command line.
+const ConfigFileEnv = "IPFS_MONITOR_CONFIG"
+
+// EnvPrefix is prepended to the upper snake case form of a field's JSON name
+// to build its environment variable, e.g. IPFS_MONITOR_CRON_EXPR.
+const EnvPrefix = "IPFS_MONITOR_"
 
 var defaultConfig = config{
-	"http://127.0.0.1:5001",
+	"",
 	"http://newtest.mboxone.com/ipfs/public/index.php/index/Call/index",
+	"",
 	"@every 60s",
 	5,
-	string(1 * time.Minute),
-	string(3 * time.Minute),
+	Duration{1 * time.Minute},
+	Duration{3 * time.Minute},
+	Duration{5 * time.Minute},
+	Duration{1 * time.Hour},
+	1 << 30,
+	"",
+	"",
 }
 
+// lock guards the current config, sources and overrides. It is only held
+// while a loaded config is merged and swapped in, loadLock serializes loads
+// across the slow fetch of the remote config.
+var lock sync.RWMutex
+
+var loadLock sync.Mutex
+
 var currentConfig = defaultConfig
 
+var currentPath string
+
+var sources = defaultSources()
+
+var overrides = make(map[string]string)
+
+// Field describes one effective configuration value and where it came from
+type Field struct {
+	Name   string
+	Env    string
+	Value  interface{}
+	Source string
+}
+
+// GetCurrentConfig returns a snapshot of the current config, it is not
+// affected by later reloads
 func GetCurrentConfig() *config {
-	return &currentConfig
+	lock.RLock()
+	defer lock.RUnlock()
+	c := currentConfig
+	return &c
 }
 func GetHTTPTimeout() time.Duration {
-	td, err := time.ParseDuration(currentConfig.HTTPTimeout)
+	return GetCurrentConfig().HTTPTimeout.Duration
+}
+func GetHTTPStreamTimeout() time.Duration {
+	return GetCurrentConfig().HTTPStreamTimeout.Duration
+}
+
+// GetServerPubKey returns the key responses of the report server are verified
+// with, the operator key unless serverPubKey is set
+func GetServerPubKey() string {
+	if key := GetCurrentConfig().ServerPubKey; key != "" {
+		return key
+	}
+	return OperatorPubKey
+}
+
+// GetReloadInterval returns how often the remote config is polled, zero
+// disables polling
+func GetReloadInterval() time.Duration {
+	return GetCurrentConfig().ReloadInterval.Duration
+}
+
+// GetFullReportInterval returns how often the full pin list is reported, zero
+// reports it every time
+func GetFullReportInterval() time.Duration {
+	return GetCurrentConfig().FullReportInterval.Duration
+}
+
+// GetSpaceMargin returns the number of bytes pins have to leave free on the
+// repo disk
+func GetSpaceMargin() uint64 {
+	return uint64(GetCurrentConfig().SpaceMargin)
+}
+
+// Override sets a field by its JSON name with the highest precedence, it
+// survives every later Load
+func Override(name string, value string) error {
+	f, ok := fieldByName(name)
+	if !ok {
+		return fmt.Errorf("Unknown config field: %s", name)
+	}
+	lock.Lock()
+	overrides[jsonName(f)] = value
+	lock.Unlock()
+	return nil
+}
+
+// Load builds the current config by layering the local config file (path or
+// $IPFS_MONITOR_CONFIG), the signed remote config, environment variables and
+// overrides over the defaults. A remote config that cannot be fetched or
+// verified is replaced by the cached copy of the last good one, one making the
+// result invalid is logged and skipped. Any other error leaves the current
+// config untouched and lists every invalid field in a ValidationError.
+func Load(path string) error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+	lock.Lock()
+	currentPath = path
+	lock.Unlock()
+	return load()
+}
+
+// Reload loads the config again from the same sources as the last Load
+func Reload() error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+	return load()
+}
+
+// load reads the file and fetches the remote config without holding lock,
+// readers of the current config are not blocked while the config server is
+// slow. loadLock must be held.
+func load() error {
+	lock.RLock()
+	path := currentPath
+	lock.RUnlock()
+	if path == "" {
+		path = os.Getenv(ConfigFileEnv)
+	}
+	var file map[string]interface{}
+	if path != "" {
+		var err error
+		file, err = readFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	remote, remoteSource, signed := remoteLayer()
+	lock.Lock()
+	result, src, err := merge(file, remote, remoteSource)
+	if err != nil && remote != nil {
+		log.Println("Ignore remote config, error: ", err)
+		result, src, err = merge(file, nil, "")
+		remoteSource = ""
+	}
+	if err == nil {
+		currentConfig = result
+		sources = src
+	}
+	lock.Unlock()
 	if err != nil {
-		td = 1 * time.Minute
+		return err
+	}
+	if remoteSource != "" && signed.serial > remoteSerial {
+		remoteSerial = signed.serial
 	}
-	return td
+	if remoteSource == SourceRemote {
+		if err := writeCache(signed); err != nil {
+			log.Println("Cache remote config failed, error: ", err)
+		}
+	}
+	return nil
 }
-func GetHTTPStreamTimeout() time.Duration {
-	td, err := time.ParseDuration(currentConfig.HTTPStreamTimeout)
+
+// merge layers file, remote, environment variables and overrides over the
+// defaults and validates the result
+func merge(file map[string]interface{}, remote map[string]interface{}, remoteSource string) (config, map[string]string, error) {
+	var errs ValidationError
+	result := defaultConfig
+	src := defaultSources()
+	unknown, fieldErrs := apply(&result, file, SourceFile, src)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{name, SourceFile, "unknown field"})
+	}
+	errs = append(errs, fieldErrs...)
+	unknown, fieldErrs = apply(&result, remote, remoteSource, src)
+	if len(unknown) > 0 {
+		log.Println("Ignore unknown fields in remote config: ", strings.Join(unknown, ", "))
+	}
+	errs = append(errs, fieldErrs...)
+	for _, f := range fieldList() {
+		if value, ok := os.LookupEnv(envName(f)); ok {
+			src[jsonName(f)] = SourceEnv
+			if err := setString(&result, f, value); err != nil {
+				errs = append(errs, FieldError{jsonName(f), SourceEnv, fmt.Sprintf("invalid %s: %s", envName(f), err)})
+			}
+		}
+	}
+	for name, value := range overrides {
+		f, _ := fieldByName(name)
+		src[name] = SourceFlag
+		if err := setString(&result, f, value); err != nil {
+			errs = append(errs, FieldError{name, SourceFlag, err.Error()})
+		}
+	}
+	if errs = validateAll(&result, src, errs); len(errs) > 0 {
+		return result, src, errs
+	}
+	return result, src, nil
+}
+
+// Fields lists every field of the current config with the source it came from
+func Fields() []Field {
+	lock.RLock()
+	defer lock.RUnlock()
+	v := reflect.ValueOf(currentConfig)
+	var fields []Field
+	for _, f := range fieldList() {
+		fields = append(fields, Field{
+			Name:   jsonName(f),
+			Env:    envName(f),
+			Value:  redact(f, v.FieldByIndex(f.Index)),
+			Source: sources[jsonName(f)],
+		})
+	}
+	return fields
+}
+
+// redact hides the values of fields tagged `secret:"true"` and passwords in
+// URLs
+func redact(f reflect.StructField, value reflect.Value) interface{} {
+	if f.Tag.Get("secret") == "true" && !value.IsZero() {
+		return "<redacted>"
+	}
+	if value.Kind() == reflect.String {
+		if u, err := url.Parse(value.String()); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+	}
+	return value.Interface()
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	layer := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(content, &layer)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &layer)
+	case ".toml":
+		err = toml.Unmarshal(content, &layer)
+	default:
+		return nil, fmt.Errorf("Unsupported config file format: %s", path)
+	}
 	if err != nil {
-		td = 3 * time.Minute
+		return nil, fmt.Errorf("Parse config file %s failed: %s", path, err)
+	}
+	return layer, nil
+}
+
+// apply decodes every known key of layer into cfg and records its source,
+// keys matching no field are returned in unknown
+func apply(cfg *config, layer map[string]interface{}, source string, src map[string]string) (unknown []string, errs ValidationError) {
+	v := reflect.ValueOf(cfg).Elem()
+	for key, value := range layer {
+		f, ok := fieldByName(key)
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		src[jsonName(f)] = source
+		raw, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(raw, v.FieldByIndex(f.Index).Addr().Interface())
+		}
+		if err != nil {
+			errs = append(errs, FieldError{jsonName(f), source, err.Error()})
+		}
 	}
-	return td
+	sort.Strings(unknown)
+	return unknown, errs
 }
 
-func init() {
-	resp, err := http.Get(configServer)
-	var result config
-	if err == nil && resp.StatusCode == http.StatusOK {
-		jsonErr := json.NewDecoder(resp.Body).Decode(&result)
-		if jsonErr != nil {
-			currentConfig = defaultConfig
-			log.Println("json解析错误 %s", jsonErr)
-		} else {
-			currentConfig = result
+// setString parses a textual value, as given by environment variables or
+// flags, into the field f of cfg
+func setString(cfg *config, f reflect.StructField, value string) error {
+	field := reflect.ValueOf(cfg).Elem().FieldByIndex(f.Index)
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+func fieldList() []reflect.StructField {
+	t := reflect.TypeOf(config{})
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+	}
+	return fields
+}
+
+func fieldByName(name string) (reflect.StructField, bool) {
+	for _, f := range fieldList() {
+		if strings.EqualFold(jsonName(f), name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
+
+// envName turns the JSON name into its environment variable, "httpTimeout"
+// becomes IPFS_MONITOR_HTTP_TIMEOUT
+func envName(f reflect.StructField) string {
+	var b strings.Builder
+	for i, r := range jsonName(f) {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
 		}
-	} else {
-		currentConfig = defaultConfig
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return EnvPrefix + b.String()
+}
+
+func defaultSources() map[string]string {
+	src := make(map[string]string)
+	for _, f := range fieldList() {
+		src[jsonName(f)] = SourceDefault
+	}
+	return src
+}
+
+func copySources(src map[string]string) map[string]string {
+	c := make(map[string]string, len(src))
+	for k, v := range src {
+		c[k] = v
 	}
+	return c
 }
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setOverrides replaces the overrides for a test and returns the function
+// restoring them
+func setOverrides(values map[string]string) func() {
+	lock.Lock()
+	saved := overrides
+	overrides = values
+	lock.Unlock()
+	return func() {
+		lock.Lock()
+		overrides = saved
+		lock.Unlock()
+	}
+}
+
+// setEnv sets the environment variables of a test and returns the function
+// unsetting them
+func setEnv(values map[string]string) func() {
+	for name, value := range values {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range values {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		field string
+		env   string
+		flag  string
+	}{
+		{"baseUrl", "IPFS_MONITOR_BASE_URL", "ipfs_base_url"},
+		{"serverPubKey", "IPFS_MONITOR_SERVER_PUB_KEY", "server_pub_key"},
+		{"httpTimeout", "IPFS_MONITOR_HTTP_TIMEOUT", "http_timeout"},
+		{"fullReportInterval", "IPFS_MONITOR_FULL_REPORT_INTERVAL", "full_report_interval"},
+		{"ipfsAuthFile", "IPFS_MONITOR_IPFS_AUTH_FILE", "ipfs_auth_file"},
+		{"HTTPTIMEOUT", "IPFS_MONITOR_HTTP_TIMEOUT", "http_timeout"},
+	}
+	for _, test := range tests {
+		f, ok := fieldByName(test.field)
+		if !ok {
+			t.Errorf("fieldByName(%q) found no field", test.field)
+			continue
+		}
+		if env, flag := envName(f), flagName(f); env != test.env || flag != test.flag {
+			t.Errorf("%s: env %s, flag %s, want %s, %s", test.field, env, flag, test.env, test.flag)
+		}
+	}
+	if _, ok := fieldByName("serial"); ok {
+		t.Error("fieldByName(serial) found a field")
+	}
+}
+
+func TestMergePrecedence(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         map[string]interface{}
+		remote       map[string]interface{}
+		remoteSource string
+		env          map[string]string
+		flags        map[string]string
+		jobCount     int
+		source       string
+	}{
+		{name: "default", jobCount: 5, source: SourceDefault},
+		{name: "file", file: map[string]interface{}{"jobCount": 2.0}, jobCount: 2, source: SourceFile},
+		{name: "remote over file", file: map[string]interface{}{"jobCount": 2.0},
+			remote: map[string]interface{}{"jobCount": 3.0}, remoteSource: SourceRemote, jobCount: 3, source: SourceRemote},
+		{name: "cached remote", remote: map[string]interface{}{"jobCount": 3.0},
+			remoteSource: SourceRemoteCache, jobCount: 3, source: SourceRemoteCache},
+		{name: "env over remote", remote: map[string]interface{}{"jobCount": 3.0}, remoteSource: SourceRemote,
+			env: map[string]string{"IPFS_MONITOR_JOB_COUNT": "4"}, jobCount: 4, source: SourceEnv},
+		{name: "flag over env", file: map[string]interface{}{"jobCount": 2.0},
+			remote: map[string]interface{}{"jobCount": 3.0}, remoteSource: SourceRemote,
+			env: map[string]string{"IPFS_MONITOR_JOB_COUNT": "4"}, flags: map[string]string{"jobCount": "6"}, jobCount: 6, source: SourceFlag},
+		{name: "flag only", flags: map[string]string{"jobCount": "6"}, jobCount: 6, source: SourceFlag},
+		{name: "unknown remote field ignored", remote: map[string]interface{}{"jobCount": 3.0, "newField": "x"},
+			remoteSource: SourceRemote, jobCount: 3, source: SourceRemote},
+	}
+	for _, test := range tests {
+		restoreOverrides := setOverrides(test.flags)
+		unsetEnv := setEnv(test.env)
+		result, src, err := merge(test.file, test.remote, test.remoteSource)
+		unsetEnv()
+		restoreOverrides()
+		if err != nil {
+			t.Errorf("%s: merge failed: %s", test.name, err)
+			continue
+		}
+		if result.JobCount != test.jobCount || src["jobCount"] != test.source {
+			t.Errorf("%s: jobCount %d from %s, want %d from %s", test.name, result.JobCount, src["jobCount"], test.jobCount, test.source)
+		}
+		if result.CronExpr != defaultConfig.CronExpr || src["cronExpr"] != SourceDefault {
+			t.Errorf("%s: cronExpr %q from %s, want the default", test.name, result.CronExpr, src["cronExpr"])
+		}
+	}
+}
+
+func TestMergeTypes(t *testing.T) {
+	file := map[string]interface{}{"httpTimeout": "90s", "serverUrl": "https://report.local/call", "spaceMargin": 1024.0}
+	defer setOverrides(map[string]string{"reloadInterval": "0s"})()
+	defer setEnv(map[string]string{"IPFS_MONITOR_FULL_REPORT_INTERVAL": "2h", "IPFS_MONITOR_IPFS_AUTH": "bearer:token"})()
+	result, _, err := merge(file, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig
+	want.HTTPTimeout.Duration = 90 * time.Second
+	want.ServerUrl = "https://report.local/call"
+	want.SpaceMargin = 1024
+	want.ReloadInterval.Duration = 0
+	want.FullReportInterval.Duration = 2 * time.Hour
+	want.IPFSAuth = "bearer:token"
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("merge = %+v, want %+v", result, want)
+	}
+}
+
+func TestMergeValidation(t *testing.T) {
+	file := map[string]interface{}{
+		"cronExpr":     "every minute",
+		"jobCount":     0.0,
+		"httpTimeout":  90.0,
+		"unknownField": true,
+	}
+	defer setOverrides(map[string]string{"serverUrl": "ftp://report.local"})()
+	defer setEnv(map[string]string{"IPFS_MONITOR_SPACE_MARGIN": "-1", "IPFS_MONITOR_RELOAD_INTERVAL": "soon"})()
+	_, _, err := merge(file, nil, "")
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("merge error %v, want a ValidationError", err)
+	}
+	want := []struct{ field, source string }{
+		{"cronExpr", SourceFile},
+		{"httpTimeout", SourceFile},
+		{"jobCount", SourceFile},
+		{"reloadInterval", SourceEnv},
+		{"serverUrl", SourceFlag},
+		{"spaceMargin", SourceEnv},
+		{"unknownField", SourceFile},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("merge rejected %d fields, want %d:\n%s", len(errs), len(want), errs)
+	}
+	for i, w := range want {
+		if errs[i].Field != w.field || errs[i].Source != w.source {
+			t.Errorf("error %d is %s from %s, want %s from %s", i, errs[i].Field, errs[i].Source, w.field, w.source)
+		}
+	}
+	if !strings.Contains(errs.Error(), "7 field(s) rejected") {
+		t.Errorf("error message %q does not count the rejected fields", errs.Error())
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	defer setOverrides(make(map[string]string))()
+	fs := flag.NewFlagSet("ipfs-monitor", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	RegisterFlags(fs)
+	for _, f := range fieldList() {
+		if fs.Lookup(flagName(f)) == nil {
+			t.Errorf("no flag for %s", jsonName(f))
+		}
+	}
+	if err := fs.Parse([]string{"-job_count", "x"}); err == nil {
+		t.Error("Parse accepted job_count x")
+	}
+	if err := fs.Parse([]string{"-job_count", "7", "-ipfs_base_url", "/ip4/127.0.0.1/tcp/5001", "-http_timeout", "30s"}); err != nil {
+		t.Fatal(err)
+	}
+	result, src, err := merge(nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.JobCount != 7 || result.BaseUrl != "/ip4/127.0.0.1/tcp/5001" || result.HTTPTimeout.Duration != 30*time.Second {
+		t.Errorf("flags set jobCount %d, baseUrl %q, httpTimeout %s", result.JobCount, result.BaseUrl, result.HTTPTimeout)
+	}
+	for _, name := range []string{"jobCount", "baseUrl", "httpTimeout"} {
+		if src[name] != SourceFlag {
+			t.Errorf("%s from %s, want %s", name, src[name], SourceFlag)
+		}
+	}
+}
+
+func TestTakeSerial(t *testing.T) {
+	tests := []struct {
+		config string
+		serial uint64
+		err    bool
+	}{
+		{config: `{"serial": 42, "jobCount": 3}`, serial: 42},
+		{config: `{"serial": 18446744073709551615}`, serial: 18446744073709551615},
+		{config: `{"jobCount": 3}`, err: true},
+		{config: `{"serial": 0}`, err: true},
+		{config: `{"serial": -1}`, err: true},
+		{config: `{"serial": 1.5}`, err: true},
+		{config: `{"serial": "42"}`, err: true},
+	}
+	for _, test := range tests {
+		layer := make(map[string]interface{})
+		decoder := json.NewDecoder(strings.NewReader(test.config))
+		decoder.UseNumber()
+		if err := decoder.Decode(&layer); err != nil {
+			t.Fatal(err)
+		}
+		serial, err := takeSerial(layer)
+		if test.err {
+			if err == nil {
+				t.Errorf("takeSerial(%s) = %d, want error", test.config, serial)
+			}
+			continue
+		}
+		if err != nil || serial != test.serial {
+			t.Errorf("takeSerial(%s) = %d, %v, want %d", test.config, serial, err, test.serial)
+		}
+		if _, ok := layer[serialField]; ok {
+			t.Errorf("takeSerial(%s) left the serial in the layer", test.config)
+		}
+	}
+}
+
+// roundTripFunc serves the requests of remoteClient in tests
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestReloadDoesNotBlockReaders(t *testing.T) {
+	cache, err := ioutil.TempDir("", "ipfs-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer func(file string, client *http.Client) {
+		RemoteCacheFile, remoteClient = file, client
+	}(RemoteCacheFile, remoteClient)
+	RemoteCacheFile = cache + "/remote_config.json"
+	fetching, release := make(chan bool), make(chan bool)
+	remoteClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		fetching <- true
+		<-release
+		return nil, errors.New("config server unreachable")
+	})}
+
+	done := make(chan error)
+	go func() { done <- Reload() }()
+	<-fetching
+	read := make(chan bool)
+	go func() {
+		GetCurrentConfig()
+		GetSpaceMargin()
+		Fields()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Error("config readers blocked while the remote config is fetched")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Reload failed: %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"reflect"
+)
+
+// FieldDiff is a field whose effective value differs from the remote config
+type FieldDiff struct {
+	Name   string
+	Value  interface{}
+	Source string
+	Remote interface{}
+}
+
+// ValidateFile checks a local config file on its own, layered over the
+// defaults only
+func ValidateFile(path string) error {
+	layer, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	result := defaultConfig
+	src := defaultSources()
+	unknown, errs := apply(&result, layer, SourceFile, src)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{name, SourceFile, "unknown field"})
+	}
+	if errs = validateAll(&result, src, errs); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Diff fetches and verifies the remote config and compares every field it
+// sets with the current config
+func Diff() ([]FieldDiff, error) {
+	signed, err := fetchRemote()
+	if err != nil {
+		return nil, err
+	}
+	layer, err := signed.layer()
+	if err != nil {
+		return nil, err
+	}
+	remote := defaultConfig
+	src := make(map[string]string)
+	if _, errs := apply(&remote, layer, SourceRemote, src); len(errs) > 0 {
+		return nil, errs
+	}
+	lock.RLock()
+	current := reflect.ValueOf(currentConfig)
+	currentSources := copySources(sources)
+	lock.RUnlock()
+	remoteValue := reflect.ValueOf(remote)
+	var diffs []FieldDiff
+	for _, f := range fieldList() {
+		name := jsonName(f)
+		if src[name] != SourceRemote {
+			continue
+		}
+		value, remote := current.FieldByIndex(f.Index), remoteValue.FieldByIndex(f.Index)
+		if !reflect.DeepEqual(value.Interface(), remote.Interface()) {
+			diffs = append(diffs, FieldDiff{name, redact(f, value), currentSources[name], redact(f, remote)})
+		}
+	}
+	return diffs, nil
+}
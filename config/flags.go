@@ -0,0 +1,85 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// fieldFlag binds a config field to a command-line flag, a value set on the
+// command line overrides every other source
+type fieldFlag struct {
+	field reflect.StructField
+}
+
+func (f *fieldFlag) String() string {
+	if f == nil || f.field.Index == nil {
+		return ""
+	}
+	return fmt.Sprint(reflect.ValueOf(defaultConfig).FieldByIndex(f.field.Index).Interface())
+}
+
+func (f *fieldFlag) Set(value string) error {
+	check := defaultConfig
+	if err := setString(&check, f.field, value); err != nil {
+		return err
+	}
+	return Override(jsonName(f.field), value)
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.field.Type.Kind() == reflect.Bool
+}
+
+// typeName is the placeholder shown for the flag's value in the help output
+func (f *fieldFlag) typeName() string {
+	if f.field.Type == reflect.TypeOf(Duration{}) {
+		return "duration"
+	}
+	if f.IsBoolFlag() {
+		return ""
+	}
+	return f.field.Type.Kind().String()
+}
+
+// RegisterFlags defines a flag for every config field on fs. The flag is
+// named by the field's `flag` tag or the snake case form of its JSON name,
+// and its help text by the `usage` tag followed by the environment variable.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, f := range fieldList() {
+		usage := f.Tag.Get("usage")
+		if usage == "" {
+			usage = jsonName(f)
+		}
+		fs.Var(&fieldFlag{f}, flagName(f), fmt.Sprintf("%s (env %s)", usage, envName(f)))
+	}
+}
+
+// PrintDefaults works like flag.PrintDefaults but names the value type of
+// the flags defined by RegisterFlags
+func PrintDefaults(fs *flag.FlagSet, w io.Writer) {
+	fs.VisitAll(func(fl *flag.Flag) {
+		name, usage := flag.UnquoteUsage(fl)
+		if ff, ok := fl.Value.(*fieldFlag); ok {
+			name = ff.typeName()
+		}
+		line := "  -" + fl.Name
+		if name != "" {
+			line += " " + name
+		}
+		line += "\n    \t" + strings.Replace(usage, "\n", "\n    \t", -1)
+		if fl.DefValue != "" {
+			line += fmt.Sprintf(" (default %q)", fl.DefValue)
+		}
+		fmt.Fprintln(w, line)
+	})
+}
+
+func flagName(f reflect.StructField) string {
+	if name := f.Tag.Get("flag"); name != "" {
+		return name
+	}
+	return strings.ToLower(strings.TrimPrefix(envName(f), EnvPrefix))
+}
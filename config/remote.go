@@ -0,0 +1,222 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"ipfs-monitor/verifier"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configServer = "http://hash.iptokenmain.com/monitor/config.json"
+
+// signatureSuffix is appended to configServer to get the detached signature
+// of the remote config, a hex encoded signature of the exact response body
+const signatureSuffix = ".sig"
+
+const maxRemoteConfigSize = 1 << 20
+
+// OperatorPubKey is the base64 encoded libp2p public key of the IPHash
+// operator, the only key trusted to sign the remote config. It is pinned at
+// build time with
+//
+//	go build -ldflags "-X ipfs-monitor/config.OperatorPubKey=<key>"
+//
+// and the remote config is rejected when it is empty.
+var OperatorPubKey string
+
+var remoteClient = &http.Client{Timeout: 1 * time.Minute}
+
+// serialField is the key of the remote config holding its serial, a positive
+// integer the operator raises with every new config. It is part of the signed
+// content, so an older signed config cannot be replayed in place of a newer
+// one.
+const serialField = "serial"
+
+// RemoteCacheEnv is the environment variable holding the path of the cached
+// remote config, used when RemoteCacheFile is empty.
+const RemoteCacheEnv = "IPFS_MONITOR_REMOTE_CACHE"
+
+// RemoteCacheFile is the path of the cached remote config. When it and
+// $IPFS_MONITOR_REMOTE_CACHE are empty the cache is kept in the user cache
+// directory, or next to the executable when there is none.
+var RemoteCacheFile string
+
+// remoteSerial is the serial of the last remote config used, guarded by
+// loadLock. Remote configs with a lower serial are rejected even when the
+// cache cannot be written.
+var remoteSerial uint64
+
+// signedConfig is the remote config as served together with its detached
+// signature, it is cached on disk in this form and verified again when read.
+// serial is set by layer.
+type signedConfig struct {
+	Config    string `json:"config"`
+	Signature string `json:"signature"`
+	serial    uint64
+}
+
+// remoteLayer returns the verified remote config, or the cached copy of the
+// last good one when the config server is unreachable, not trusted or serves
+// a config older than the cached one
+func remoteLayer() (map[string]interface{}, string, *signedConfig) {
+	cached, cacheErr := readCache()
+	var cachedLayer map[string]interface{}
+	if cacheErr == nil {
+		cachedLayer, cacheErr = cached.layer()
+	}
+	floor := remoteSerial
+	if cacheErr == nil && cached.serial > floor {
+		floor = cached.serial
+	}
+	signed, err := fetchRemote()
+	if err == nil {
+		var layer map[string]interface{}
+		if layer, err = signed.layer(); err == nil {
+			if signed.serial >= floor {
+				return layer, SourceRemote, signed
+			}
+			err = fmt.Errorf("serial %d is older than serial %d of the last remote config", signed.serial, floor)
+		}
+	}
+	log.Println("Reject remote config, error: ", err)
+	if cacheErr != nil {
+		if !os.IsNotExist(cacheErr) {
+			log.Println("Reject cached remote config, error: ", cacheErr)
+		}
+		return nil, "", nil
+	}
+	if cached.serial < remoteSerial {
+		log.Printf("Reject cached remote config, serial %d is older than serial %d of the last remote config\n", cached.serial, remoteSerial)
+		return nil, "", nil
+	}
+	log.Println("Use cached remote config")
+	return cachedLayer, SourceRemoteCache, cached
+}
+
+func fetchRemote() (*signedConfig, error) {
+	content, err := httpGet(configServer)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := httpGet(configServer + signatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Get remote config signature failed: %s", err)
+	}
+	return &signedConfig{Config: string(content), Signature: strings.TrimSpace(string(signature))}, nil
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := remoteClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Get %s failed: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize))
+}
+
+// layer verifies the signature against OperatorPubKey and decodes the config,
+// its serial is moved from the layer to s.serial
+func (s *signedConfig) layer() (map[string]interface{}, error) {
+	if OperatorPubKey == "" {
+		return nil, errors.New("no operator public key pinned in this build")
+	}
+	if s.Signature == "" {
+		return nil, errors.New("remote config is not signed")
+	}
+	if err := verifier.Check(OperatorPubKey, s.Config, s.Signature); err != nil {
+		return nil, fmt.Errorf("verify remote config signature failed: %s", err)
+	}
+	layer := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(s.Config))
+	decoder.UseNumber()
+	if err := decoder.Decode(&layer); err != nil {
+		return nil, err
+	}
+	serial, err := takeSerial(layer)
+	if err != nil {
+		return nil, err
+	}
+	s.serial = serial
+	return layer, nil
+}
+
+// takeSerial removes the serial from a layer decoded with UseNumber and
+// returns it
+func takeSerial(layer map[string]interface{}) (uint64, error) {
+	number, ok := layer[serialField].(json.Number)
+	if !ok {
+		return 0, errors.New("remote config has no serial")
+	}
+	serial, err := strconv.ParseUint(number.String(), 10, 64)
+	if err != nil || serial == 0 {
+		return 0, fmt.Errorf("invalid remote config serial %s", number)
+	}
+	delete(layer, serialField)
+	return serial, nil
+}
+
+// cachePath is where the last good remote config is kept, it does not depend
+// on the config itself
+func cachePath() (string, error) {
+	if RemoteCacheFile != "" {
+		return RemoteCacheFile, nil
+	}
+	if path := os.Getenv(RemoteCacheEnv); path != "" {
+		return path, nil
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "ipfs-monitor", "remote_config.json"), nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("no cache directory, set %s: %s", RemoteCacheEnv, err)
+	}
+	return filepath.Join(filepath.Dir(exe), "remote_config.json"), nil
+}
+
+func readCache() (*signedConfig, error) {
+	path, err := cachePath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cached signedConfig
+	if err := json.Unmarshal(content, &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func writeCache(signed *signedConfig) error {
+	path, err := cachePath()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"ipfs-monitor/command"
+	"ipfs-monitor/verifier"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// MaxJobCount bounds the size of the pinning worker pool
+const MaxJobCount = 20
+
+// FieldError describes why the value of a config field is invalid
+type FieldError struct {
+	Field  string
+	Source string
+	Reason string
+}
+
+// ValidationError lists every invalid field of a config
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	lines := make([]string, len(e))
+	for i, fe := range e {
+		lines[i] = fmt.Sprintf("  %s (from %s): %s", fe.Field, fe.Source, fe.Reason)
+	}
+	return fmt.Sprintf("Invalid config, %d field(s) rejected:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e ValidationError) Len() int           { return len(e) }
+func (e ValidationError) Less(i, j int) bool { return e[i].Field < e[j].Field }
+func (e ValidationError) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// validate checks every field of cfg, src names the source of each field for
+// the error report
+func validate(cfg *config, src map[string]string) ValidationError {
+	var errs ValidationError
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, FieldError{field, src[field], err.Error()})
+		}
+	}
+	if cfg.BaseUrl != "" {
+		_, _, err := command.ResolveAddress(cfg.BaseUrl)
+		check("baseUrl", err)
+	}
+	check("serverUrl", validateURL(cfg.ServerUrl))
+	if cfg.ServerPubKey != "" {
+		check("serverPubKey", verifier.CheckPublicKey(cfg.ServerPubKey))
+	}
+	if _, err := cron.Parse(cfg.CronExpr); err != nil {
+		check("cronExpr", fmt.Errorf("invalid cron expression %q: %s", cfg.CronExpr, err))
+	}
+	if cfg.JobCount < 1 || cfg.JobCount > MaxJobCount {
+		check("jobCount", fmt.Errorf("%d is out of range [1, %d]", cfg.JobCount, MaxJobCount))
+	}
+	if cfg.IPFSAuth != "" {
+		check("ipfsAuth", command.CheckAuth(cfg.IPFSAuth))
+	}
+	check("httpTimeout", validatePositive(cfg.HTTPTimeout))
+	check("httpStreamTimeout", validatePositive(cfg.HTTPStreamTimeout))
+	if cfg.ReloadInterval.Duration != 0 && cfg.ReloadInterval.Duration < time.Second {
+		check("reloadInterval", fmt.Errorf("%s is shorter than 1s, use 0 to disable polling", cfg.ReloadInterval))
+	}
+	if cfg.FullReportInterval.Duration < 0 {
+		check("fullReportInterval", fmt.Errorf("%s is negative, use 0 to always report the full pin list", cfg.FullReportInterval))
+	}
+	if cfg.SpaceMargin < 0 {
+		check("spaceMargin", fmt.Errorf("%d is negative", cfg.SpaceMargin))
+	}
+	return errs
+}
+
+// validateAll adds the errors of validate for fields not already in errs,
+// which holds the fields that could not be decoded
+func validateAll(cfg *config, src map[string]string, errs ValidationError) ValidationError {
+	failed := make(map[string]bool)
+	for _, fe := range errs {
+		failed[fe.Field] = true
+	}
+	for _, fe := range validate(cfg, src) {
+		if !failed[fe.Field] {
+			errs = append(errs, fe)
+		}
+	}
+	sort.Stable(errs)
+	return errs
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+func validatePositive(d Duration) error {
+	if d.Duration <= 0 {
+		return fmt.Errorf("%s must be positive", d)
+	}
+	return nil
+}
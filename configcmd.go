@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"ipfs-monitor/config"
+	"strings"
+	"text/tabwriter"
+)
+
+// configCommand handles `config show`, `config validate <file>` and
+// `config diff` without starting the daemon
+func configCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return usage, nil
+	}
+	switch {
+	case args[0] == "show" && len(args) == 1:
+		if err := config.Load(*config_file); err != nil {
+			return "Load config failed", err
+		}
+		var b strings.Builder
+		w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FIELD\tVALUE\tSOURCE\tENV")
+		for _, field := range config.Fields() {
+			fmt.Fprintf(w, "%s\t%v\t%s\t%s\n", field.Name, field.Value, field.Source, field.Env)
+		}
+		w.Flush()
+		return strings.TrimRight(b.String(), "\n"), nil
+	case args[0] == "validate" && len(args) == 2:
+		if err := config.ValidateFile(args[1]); err != nil {
+			return "Validate " + args[1] + " failed", err
+		}
+		return args[1] + " is valid", nil
+	case args[0] == "diff" && len(args) == 1:
+		if err := config.Load(*config_file); err != nil {
+			return "Load config failed", err
+		}
+		diffs, err := config.Diff()
+		if err != nil {
+			return "Get remote config failed", err
+		}
+		if len(diffs) == 0 {
+			return "Effective config matches remote config", nil
+		}
+		var b strings.Builder
+		w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FIELD\tEFFECTIVE\tSOURCE\tREMOTE")
+		for _, diff := range diffs {
+			fmt.Fprintf(w, "%s\t%v\t%s\t%v\n", diff.Name, diff.Value, diff.Source, diff.Remote)
+		}
+		w.Flush()
+		return strings.TrimRight(b.String(), "\n"), nil
+	default:
+		return usage, nil
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"ipfs-monitor/command"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/robfig/cron"
 	"github.com/takama/daemon"
@@ -23,13 +25,15 @@ const (
 	description = "Monitor IPFS node and report status to IPHash server."
 )
 
+const usage = "Usage: ipfs_monitor [flags] install | remove | start | stop | status | config show | config validate <file> | config diff"
+
 var stdlog, errlog *log.Logger
 
-var ipfs_base_url = flag.String("ipfs_base_url", config.GetCurrentConfig().BaseUrl, "Base URL of IPFS API")
-var server_url = &config.GetCurrentConfig().ServerUrl
-var cron_expr = &config.GetCurrentConfig().CronExpr
-var job_count = &config.GetCurrentConfig().JobCount
-var httpTimeout = config.GetHTTPTimeout()
+var ipfs *command.Client
+
+var config_file = flag.String("config", "", "Path of local config file (JSON, YAML or TOML), default is $"+config.ConfigFileEnv)
+
+var remote_cache = flag.String("remote_cache", "", "Path of the cached remote config, default is $"+config.RemoteCacheEnv+" or ipfs-monitor/remote_config.json in the user cache directory")
 
 // Service is the daemon service struct
 type Service struct {
@@ -39,14 +43,18 @@ type Service struct {
 func init() {
 	stdlog = log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	errlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+	config.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\nFlags:\n", usage)
+		config.PrintDefaults(flag.CommandLine, flag.CommandLine.Output())
+	}
 }
 
 // Manage by daemon commands or run the daemon
 func (service *Service) Manage() (string, error) {
-	usage := "Usage: ipfs_monitor install | remove | start | stop | status"
-	if len(os.Args) == 2 {
-		command := os.Args[1]
-		switch command {
+	config.RemoteCacheFile = *remote_cache
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
 		case "install":
 			return service.Install()
 		case "remove":
@@ -57,44 +65,173 @@ func (service *Service) Manage() (string, error) {
 			return service.Stop()
 		case "status":
 			return service.Status()
+		case "config":
+			return configCommand(args[1:])
 		default:
 			return usage, nil
 		}
 	}
+	if err := config.Load(*config_file); err != nil {
+		return "Load config failed", err
+	}
+	var err error
+	ipfs, err = command.NewClient(config.GetCurrentConfig().BaseUrl)
+	if err != nil {
+		return "Connect IPFS API failed", err
+	}
+	if err := setIPFSAuth(config.GetCurrentConfig().IPFSAuth, config.GetCurrentConfig().IPFSAuthFile); err != nil {
+		return "Set IPFS API credential failed", err
+	}
+	stdlog.Printf("Use IPFS API: %s\n", ipfs.BaseURL())
+	ipfs.SetTimeouts(config.GetHTTPTimeout(), config.GetHTTPStreamTimeout())
+	reporter.IPFS = ipfs
+	pinner.IPFS = ipfs
+	reporter.SetReportURL(config.GetCurrentConfig().ServerUrl)
+	pinner.JobCount = config.GetCurrentConfig().JobCount
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
+	http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout = config.GetHTTPTimeout()
+	if !loadRepo() {
+		go func() {
+			for {
+				time.Sleep(restoreInterval)
+				if loadRepo() {
+					return
+				}
+			}
+		}()
+	}
 	stdlog.Println("IPFS monitor starting...")
-	stdlog.Printf("Use IPFS base URL: %s\n", *ipfs_base_url)
-	stdlog.Printf("Use server URL: %s\n", *server_url)
+	for _, field := range config.Fields() {
+		stdlog.Printf("Use config %s: %v (from %s)\n", field.Name, field.Value, field.Source)
+	}
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	c, err := schedule(config.GetCurrentConfig().CronExpr)
+	if err != nil {
+		return "Schedule reporting failed", err
+	}
+	pinner.PinService()
+	for {
+		var poll <-chan time.Time
+		if interval := config.GetReloadInterval(); interval > 0 {
+			poll = time.After(interval)
+		}
+		select {
+		case <-hangup:
+			stdlog.Println("Got SIGHUP, reloading config...")
+			c = reload(c)
+		case <-poll:
+			c = reload(c)
+		case killSignal := <-interrupt:
+			c.Stop()
+			stdlog.Println("Got signal:", killSignal)
+			return "Service exited", nil
+		}
+	}
+}
+
+// restoreInterval is the time between attempts to load the IPFS repo while
+// the IPFS node is unreachable or its identity cannot be read
+const restoreInterval = 1 * time.Minute
+
+// pinsRestored is set once the pin journal is restored, only loadRepo uses it
+var pinsRestored bool
+
+// loadRepo hands the path of the IPFS repo to the reporter, restores the pin
+// journal in it and loads the node identity reports are signed with from its
+// config. It returns false when the repo path is not known yet or the
+// identity could not be loaded and it should be tried again.
+func loadRepo() bool {
+	repo, err := ipfs.GetRepoPath(context.Background())
+	if err != nil {
+		errlog.Println("Get IPFS repo path failed, pins are journaled and reports sent once it is known, error: ", err)
+		return false
+	}
+	reporter.SetRepoPath(repo)
+	if !pinsRestored {
+		if err := pinner.Restore(repo); err != nil {
+			errlog.Println("Restore pins failed, pins are not journaled, error: ", err)
+		}
+		pinsRestored = true
+	}
+	if err := signer.Initialize(repo); err != nil {
+		errlog.Println("Load IPFS node identity failed, reports are sent once it is loaded, error: ", err)
+		return false
+	}
+	return true
+}
 
+func schedule(cronExpr string) (*cron.Cron, error) {
 	c := cron.New()
-	c.AddFunc(*cron_expr, func() {
+	err := c.AddFunc(cronExpr, func() {
 		_, err := reporter.Report()
 		if err != nil {
 			errlog.Println("Abort reporting, waiting for next turn.")
 		}
 	})
+	if err != nil {
+		return nil, err
+	}
 	c.Start()
-	pinner.PinService()
-	killSignal := <-interrupt
-	stdlog.Println("Got signal:", killSignal)
-	return "Service exited", nil
+	return c, nil
 }
 
-func main() {
-	flag.Parse()
-	command.Base_URL = *ipfs_base_url
-	reporter.Report_URL = *server_url
-	pinner.JobCount = *job_count
-	if pinner.JobCount < 1 {
-		pinner.JobCount = 1
+// reload fetches the config again and applies what changed, running reports
+// and pins are not interrupted
+func reload(c *cron.Cron) *cron.Cron {
+	old := config.GetCurrentConfig()
+	if err := config.Reload(); err != nil {
+		errlog.Println("Reload config failed, keep current config, error: ", err)
+		return c
 	}
-	if pinner.JobCount > 20 {
-		pinner.JobCount = 20
+	cfg := config.GetCurrentConfig()
+	if cfg.CronExpr != old.CronExpr {
+		next, err := schedule(cfg.CronExpr)
+		if err != nil {
+			errlog.Println("Reschedule reporting failed, error: ", err)
+		} else {
+			c.Stop()
+			c = next
+			stdlog.Printf("Reporting rescheduled with %s\n", cfg.CronExpr)
+		}
 	}
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
-	http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout = httpTimeout
-	signer.Initialize()
+	if cfg.JobCount != old.JobCount {
+		pinner.Resize(cfg.JobCount)
+		stdlog.Printf("Pinning jobs resized to %d\n", pinner.JobCount)
+	}
+	ipfs.SetTimeouts(cfg.HTTPTimeout.Duration, cfg.HTTPStreamTimeout.Duration)
+	if cfg.BaseUrl != old.BaseUrl || cfg.BaseUrl == "" {
+		previous := ipfs.BaseURL()
+		if err := ipfs.SetBaseURL(cfg.BaseUrl); err != nil {
+			errlog.Println("Switch IPFS API failed, error: ", err)
+		} else if ipfs.BaseURL() != previous {
+			stdlog.Printf("IPFS API switched to %s\n", ipfs.BaseURL())
+		}
+	}
+	if err := setIPFSAuth(cfg.IPFSAuth, cfg.IPFSAuthFile); err != nil {
+		errlog.Println("Set IPFS API credential failed, error: ", err)
+	}
+	if cfg.ServerUrl != old.ServerUrl {
+		reporter.SetReportURL(cfg.ServerUrl)
+		stdlog.Printf("Server URL switched to %s\n", cfg.ServerUrl)
+	}
+	return c
+}
+
+// setIPFSAuth applies the IPFS API credential, given directly or looked up
+// for the current address in the credential file
+func setIPFSAuth(secret string, file string) error {
+	if secret != "" || file == "" {
+		return ipfs.SetAuth(secret)
+	}
+	return ipfs.SetAuthFile(file)
+}
+
+func main() {
+	flag.Parse()
 	srv, err := daemon.New(name, description)
 	if err != nil {
 		errlog.Println("Error: ", err)
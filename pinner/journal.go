@@ -0,0 +1,250 @@
+package pinner
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// journalFile is the append-only log of pin states, it is stored in the repo
+// next to monitor_timestamp
+const journalFile = "monitor_pins"
+
+// compactLines is the journal length from which it is compacted once it has
+// twice as many lines as unfinished pins
+const compactLines = 1000
+
+// States of a pin in the journal, pins in the first three states are resumed
+// on start. A pin fails by its deadline and is given up after its attempts,
+// an unpin requested for it drops it.
+const (
+	StateQueued   = "queued"
+	StatePinning  = "pinning"
+	StateRetrying = "retrying"
+	StateDone     = "done"
+	StateFailed   = "failed"
+	StateGaveUp   = "gave_up"
+	StateUnpinned = "unpinned"
+)
+
+// journalEntry is one line of the journal, the last line of a hash holds its
+// current state
+type journalEntry struct {
+	Hash     string `json:"hash"`
+	State    string `json:"state"`
+	Priority int    `json:"priority,omitempty"`
+	Deadline int64  `json:"deadline,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+var journalLock sync.Mutex
+
+var journal *os.File
+
+var journalPath string
+
+var journalLines int
+
+// dirty tells whether entries were written since the journal was last synced
+var dirty bool
+
+// recorded holds the hashes of pins recorded before the journal was
+// restored, their state in memory replaces the one in the journal
+var recorded = make(map[string]bool)
+
+// unfinished pins by hash with their last entry and first position
+var unfinished = make(map[string]journalEntry)
+var order = make(map[string]int)
+var nextOrder int
+
+// Restore opens the journal in the repo at path and queues the pins that were
+// not finished, pins waiting for a retry are tried right away. Pins recorded
+// before are added to the journal and pins are journaled from now on. Until
+// it is restored pins are kept in memory only, Restore may be called again
+// after it failed to read the journal.
+func Restore(path string) error {
+	journalLock.Lock()
+	file := path + "/" + journalFile
+	entries, err := readJournal(file)
+	if err != nil {
+		journalLock.Unlock()
+		return err
+	}
+	recent := sortedUnfinished()
+	unfinished = make(map[string]journalEntry)
+	order = make(map[string]int)
+	for _, entry := range entries {
+		if !recorded[entry.Hash] {
+			track(entry)
+		}
+	}
+	resume := sortedUnfinished()
+	for _, entry := range recent {
+		track(entry)
+	}
+	recorded = make(map[string]bool)
+	journalPath = file
+	err = compact()
+	journalLock.Unlock()
+	pins := make([]Pin, len(resume))
+	for i, entry := range resume {
+		pins[i] = Pin{Hash: entry.Hash, Priority: entry.Priority, Attempts: entry.Attempts}
+		if entry.Deadline > 0 {
+			pins[i].Deadline = time.Unix(entry.Deadline, 0)
+		}
+	}
+	if len(pins) > 0 {
+		stdlog.Printf("Resume %d unfinished pins\n", len(pins))
+	}
+	PinAsync(pins)
+	return err
+}
+
+// record journals the new state of pin, syncJournal makes it durable
+func record(pin Pin, state string, detail string) {
+	entry := journalEntry{Hash: pin.Hash, State: state, Priority: pin.Priority, Attempts: pin.Attempts, Detail: detail, Time: time.Now().Unix()}
+	if !pin.Deadline.IsZero() {
+		entry.Deadline = pin.Deadline.Unix()
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	track(entry)
+	if journalPath == "" {
+		recorded[entry.Hash] = true
+		return
+	}
+	if journal == nil {
+		return
+	}
+	if err := writeEntry(journal, entry); err != nil {
+		errlog.Println("Write pin journal failed, error: ", err)
+		return
+	}
+	dirty = true
+	journalLines++
+	if journalLines >= compactLines && journalLines >= 2*len(unfinished) {
+		if err := compact(); err != nil {
+			errlog.Println("Compact pin journal failed, error: ", err)
+		}
+	}
+}
+
+// syncJournal flushes the entries recorded so far to disk. It is called once
+// per batch of records without holding lock, so a response with many pins
+// costs one sync and does not stall the workers.
+func syncJournal() {
+	journalLock.Lock()
+	f := journal
+	if !dirty || f == nil {
+		journalLock.Unlock()
+		return
+	}
+	dirty = false
+	journalLock.Unlock()
+	// a compaction in the meantime closes f after syncing its replacement
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		errlog.Println("Sync pin journal failed, error: ", err)
+	}
+}
+
+// track updates unfinished by entry, journalLock must be held
+func track(entry journalEntry) {
+	switch entry.State {
+	case StateDone, StateFailed, StateGaveUp, StateUnpinned:
+		delete(unfinished, entry.Hash)
+		delete(order, entry.Hash)
+	default:
+		if _, ok := order[entry.Hash]; !ok {
+			nextOrder++
+			order[entry.Hash] = nextOrder
+		}
+		unfinished[entry.Hash] = entry
+	}
+}
+
+// sortedUnfinished returns the unfinished pins in the order they were first
+// recorded, journalLock must be held
+func sortedUnfinished() []journalEntry {
+	entries := make([]journalEntry, 0, len(unfinished))
+	for _, entry := range unfinished {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return order[entries[i].Hash] < order[entries[j].Hash] })
+	return entries
+}
+
+// compact rewrites the journal with the unfinished pins only and reopens it
+// for appending, journalLock must be held
+func compact() error {
+	if journal != nil {
+		journal.Close()
+		journal = nil
+	}
+	entries := sortedUnfinished()
+	tmp := journalPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, journalPath); err != nil {
+		return err
+	}
+	journal, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	journalLines = len(entries)
+	dirty = false
+	return err
+}
+
+func writeEntry(f *os.File, entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// readJournal reads the entries of the journal file, a line cut off by a
+// crash is skipped
+func readJournal(file string) ([]journalEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			errlog.Println("Skip broken pin journal line, error: ", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,166 @@
+package pinner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"ipfs-monitor/queue"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetState forgets every pin and closes the journal, tests run against the
+// package state
+func resetState() {
+	lock.Lock()
+	pending = make(map[string]Pin)
+	running = make(map[string]context.CancelFunc)
+	retries = make(map[string]*time.Timer)
+	inflight = make(map[string]*PinStatus)
+	pinQueue = queue.NewPriorityQueue()
+	pinningCount = 0
+	lock.Unlock()
+	journalLock.Lock()
+	if journal != nil {
+		journal.Close()
+	}
+	journal = nil
+	journalPath = ""
+	journalLines = 0
+	dirty = false
+	unfinished = make(map[string]journalEntry)
+	order = make(map[string]int)
+	nextOrder = 0
+	recorded = make(map[string]bool)
+	journalLock.Unlock()
+}
+
+func tempRepo(t *testing.T, content string) string {
+	repo, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "" {
+		if err := ioutil.WriteFile(repo+"/"+journalFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func readLines(t *testing.T, repo string) []string {
+	content, err := ioutil.ReadFile(repo + "/" + journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestRestore(t *testing.T) {
+	resetState()
+	defer resetState()
+	repo := tempRepo(t, `{"hash":"QmA","state":"queued","time":1}
+{"hash":"QmB","state":"queued","priority":2,"deadline":4102444800,"time":1}
+{"hash":"QmC","state":"queued","time":1}
+{"hash":"QmA","state":"pinning","time":2}
+{"hash":"QmC","state":"done","time":3}
+{"hash":"QmD","state":"queued","time":3}
+{"hash":"QmD","state":"retrying","attempts":2,"detail":"time out","time":4}
+{"hash":"QmE","state":"queued","time":4}
+{"hash":"QmE","state":"gave_up","attempts":5,"time":5}
+{"hash":"QmF","state":"queued","ti
+`)
+	defer os.RemoveAll(repo)
+
+	if err := Restore(repo); err != nil {
+		t.Fatal(err)
+	}
+	want := []QueuedPin{
+		{Hash: "QmB", Priority: 2, Deadline: 4102444800, Position: 1},
+		{Hash: "QmA", Position: 2},
+		{Hash: "QmD", Position: 3},
+	}
+	if got := Queued(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queued() = %+v, want %+v", got, want)
+	}
+	if attempts := pending["QmD"].Attempts; attempts != 2 {
+		t.Errorf("QmD resumed with %d attempts, want 2", attempts)
+	}
+	if count := PinningFileSize(); count != 3 {
+		t.Errorf("PinningFileSize() = %d, want 3", count)
+	}
+	// compacted to the unfinished pins, followed by the records of resuming
+	lines := readLines(t, repo)
+	var hashes []string
+	for _, line := range lines[:3] {
+		var entry journalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, entry.Hash)
+	}
+	if !reflect.DeepEqual(hashes, []string{"QmA", "QmB", "QmD"}) {
+		t.Errorf("compacted journal starts with %v, want [QmA QmB QmD]", hashes)
+	}
+	if len(lines) != 6 {
+		t.Errorf("journal has %d lines, want 6:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+}
+
+func TestRestoreAfterRecords(t *testing.T) {
+	resetState()
+	defer resetState()
+	repo := tempRepo(t, `{"hash":"QmA","state":"queued","time":1}
+{"hash":"QmB","state":"queued","time":1}
+`)
+	defer os.RemoveAll(repo)
+
+	// pins handled while the repo path was unknown know better than the journal
+	PinAsync([]Pin{{Hash: "QmB"}, {Hash: "QmC"}})
+	lock.Lock()
+	drop("QmB")
+	lock.Unlock()
+	if err := Restore(repo); err != nil {
+		t.Fatal(err)
+	}
+	var queued []string
+	for _, pin := range Queued(10) {
+		queued = append(queued, pin.Hash)
+	}
+	if !reflect.DeepEqual(queued, []string{"QmC", "QmA"}) {
+		t.Errorf("queue %v, want [QmC QmA]", queued)
+	}
+	journalLock.Lock()
+	_, b := unfinished["QmB"]
+	_, c := unfinished["QmC"]
+	journalLock.Unlock()
+	if b || !c {
+		t.Errorf("unfinished QmB = %v, QmC = %v, want false, true", b, c)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	resetState()
+	defer resetState()
+	repo := tempRepo(t, "")
+	defer os.RemoveAll(repo)
+	if err := Restore(repo); err != nil {
+		t.Fatal(err)
+	}
+	record(Pin{Hash: "QmKeep"}, StateQueued, "")
+	for i := 0; i < compactLines; i++ {
+		record(Pin{Hash: "QmDone"}, StateQueued, "")
+		record(Pin{Hash: "QmDone"}, StateDone, "")
+	}
+	syncJournal()
+	lines := readLines(t, repo)
+	if len(lines) >= compactLines {
+		t.Fatalf("journal has %d lines, want it compacted", len(lines))
+	}
+	if !strings.Contains(lines[0], `"QmKeep"`) {
+		t.Errorf("compacted journal starts with %s, want QmKeep", lines[0])
+	}
+}
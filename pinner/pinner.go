@@ -1,21 +1,103 @@
 package pinner
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
+	"fmt"
 	"ipfs-monitor/command"
+	"ipfs-monitor/config"
 	"ipfs-monitor/queue"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
+// IPFS is the node files are pinned on
+var IPFS *command.Client
+
 var JobCount int
 
+// MaxJobCount bounds the size of the pinning worker pool
+const MaxJobCount = config.MaxJobCount
+
 var lock sync.Mutex
 
+var workers int
+
 var pinningCount uint32
 
-var syncQueue = queue.NewSyncQueue()
+// pinQueue holds the hashes of files to pin by priority
+var pinQueue = queue.NewPriorityQueue()
+
+// pending holds the queued and running pins and running the functions
+// cancelling the running ones, both guarded by lock
+var pending = make(map[string]Pin)
+var running = make(map[string]context.CancelFunc)
+
+// unpinned holds the running pins cancelled for an unpin, guarded by lock
+var unpinned = make(map[string]bool)
+
+// retries holds the timers of failed pins waiting for their next attempt,
+// guarded by lock
+var retries = make(map[string]*time.Timer)
+
+// inflight holds the status of the running pins and the pins waiting for a
+// retry, guarded by lock
+var inflight = make(map[string]*PinStatus)
+
+// reserved is the disk space in bytes reserved for the running pins, guarded
+// by lock
+var reserved uint64
+
+// PinRetry tells how often and how fast failed pins are tried again, a pin
+// failing PinRetry.Attempts times is given up
+var PinRetry = command.RetryPolicy{Attempts: 5, BaseDelay: 1 * time.Minute, MaxDelay: 1 * time.Hour}
+
+// Pin is a file to pin, pins of higher Priority are done first. A pin not
+// done by Deadline, unless zero, is dropped and reported as failed. Attempts
+// counts the failed attempts.
+type Pin struct {
+	Hash     string
+	Priority int
+	Deadline time.Time
+	Attempts int
+}
+
+// QueuedPin is a pin waiting in the queue at Position, counting from 1, its
+// Deadline is in seconds since the epoch, 0 for none
+type QueuedPin struct {
+	Hash     string `json:"hash"`
+	Priority int    `json:"priority"`
+	Deadline int64  `json:"deadline"`
+	Position int    `json:"position"`
+}
+
+// PinStatus is an in-flight pin, State is StatePinning while its blocks are
+// fetched and StateRetrying while it waits for the next attempt. Blocks counts
+// the blocks fetched by the current or last attempt, the node reports no bytes
+// while pinning. Size is the total size of its blocks in bytes as estimated
+// from the root block, 0 if unknown. Started is the start of that attempt,
+// Started and LastProgress are in seconds since the epoch, LastProgress is 0
+// until the first block arrives.
+type PinStatus struct {
+	Hash         string `json:"hash"`
+	State        string `json:"state"`
+	Attempts     int    `json:"attempts"`
+	Blocks       uint64 `json:"blocks"`
+	Size         uint64 `json:"size,omitempty"`
+	Started      int64  `json:"started"`
+	LastProgress int64  `json:"last_progress"`
+}
+
+// maintenanceQueue holds unpins and garbage collections, they run one at a
+// time in the order they were requested
+var maintenanceQueue = queue.NewSyncQueue()
+
+// gcTask is queued in maintenanceQueue for a garbage collection, every other
+// item is the hash of a file to unpin
+type gcTask struct{}
 
 var stdlog, errlog *log.Logger
 
@@ -24,49 +106,420 @@ func init() {
 	errlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
 }
 
-func PinAsync(hashs []string) {
-	for _, hash := range hashs {
-		if !syncQueue.Has(hash) {
-			lock.Lock()
-			syncQueue.Push(hash)
-			pinningCount++
+// PinAsync queues pins, a file already queued or waiting for a retry is
+// moved up to a higher priority and gets the new deadline, a file being
+// pinned is skipped
+func PinAsync(pins []Pin) {
+	for _, pin := range pins {
+		lock.Lock()
+		if running[pin.Hash] != nil {
 			lock.Unlock()
+			continue
+		}
+		if queued, ok := pending[pin.Hash]; ok {
+			pin.Attempts = queued.Attempts
+			if pin.Priority < queued.Priority {
+				pin.Priority = queued.Priority
+			}
+			if pin != queued {
+				pending[pin.Hash] = pin
+				if _, waiting := retries[pin.Hash]; waiting {
+					record(pin, StateRetrying, "")
+				} else {
+					pinQueue.Push(pin.Hash, pin.Priority)
+					record(pin, StateQueued, "")
+				}
+			}
+		} else if pinQueue.Push(pin.Hash, pin.Priority) {
+			pinningCount++
+			pending[pin.Hash] = pin
+			record(pin, StateQueued, "")
+		}
+		lock.Unlock()
+	}
+	syncJournal()
+}
+
+// Queued lists up to max queued pins in the order they will be done
+func Queued(max int) []QueuedPin {
+	lock.Lock()
+	defer lock.Unlock()
+	entries := pinQueue.Entries()
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	queued := make([]QueuedPin, len(entries))
+	for i, entry := range entries {
+		hash := entry.Value.(string)
+		queued[i] = QueuedPin{Hash: hash, Priority: entry.Priority, Position: i + 1}
+		if deadline := pending[hash].Deadline; !deadline.IsZero() {
+			queued[i].Deadline = deadline.Unix()
 		}
 	}
+	return queued
+}
+
+// Status lists the in-flight pins, the longest running first
+func Status() []PinStatus {
+	lock.Lock()
+	defer lock.Unlock()
+	status := make([]PinStatus, 0, len(inflight))
+	for _, s := range inflight {
+		status = append(status, *s)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Started != status[j].Started {
+			return status[i].Started < status[j].Started
+		}
+		return status[i].Hash < status[j].Hash
+	})
+	return status
+}
+
+// progressed records that the running pin of hash has fetched blocks
+func progressed(hash string, blocks uint64) {
+	lock.Lock()
+	defer lock.Unlock()
+	if s, ok := inflight[hash]; ok {
+		s.Blocks = blocks
+		s.LastProgress = time.Now().Unix()
+	}
+}
+
+// DropExpired removes the queued pins and the pins waiting for a retry past
+// their deadline and reports them as failed
+func DropExpired() {
+	now := time.Now()
+	defer syncJournal()
+	lock.Lock()
+	defer lock.Unlock()
+	for hash, pin := range pending {
+		if pin.Deadline.IsZero() || !now.After(pin.Deadline) || running[hash] != nil {
+			continue
+		}
+		if timer, waiting := retries[hash]; waiting {
+			timer.Stop()
+			delete(retries, hash)
+		} else {
+			pinQueue.Remove(hash)
+		}
+		expire(hash)
+	}
+}
+
+// expire reports the pin of hash as failed by its deadline, lock must be held
+func expire(hash string) {
+	pin := pending[hash]
+	errlog.Printf("Drop file %s, deadline %s passed\n", hash, pin.Deadline.Format(time.RFC3339))
+	command.AddFailure(command.FailItem{Hash: hash, Code: command.FailDeadline, Detail: "deadline exceeded", Attempts: pin.Attempts})
+	finish(pin, StateFailed, "deadline exceeded")
+}
+
+// retry schedules the next attempt of pin after it failed with err, or gives
+// up once the attempts are used up or the next one would start after the
+// deadline, lock must be held
+func retry(pin Pin, err error) {
+	pin.Attempts++
+	if pin.Attempts >= PinRetry.Attempts {
+		errlog.Printf("Give up file %s after %d attempts\n", pin.Hash, pin.Attempts)
+		command.AddFailure(command.FailItem{Hash: pin.Hash, Code: command.FailCode(err), Detail: err.Error(), Attempts: pin.Attempts})
+		finish(pin, StateGaveUp, err.Error())
+		return
+	}
+	delay := PinRetry.Delay(pin.Attempts - 1)
+	pending[pin.Hash] = pin
+	if !pin.Deadline.IsZero() && time.Now().Add(delay).After(pin.Deadline) {
+		expire(pin.Hash)
+		return
+	}
+	stdlog.Printf("Retry file %s in %s, attempt %d of %d\n", pin.Hash, delay.Round(time.Second), pin.Attempts+1, PinRetry.Attempts)
+	record(pin, StateRetrying, err.Error())
+	if s, ok := inflight[pin.Hash]; ok {
+		s.State = StateRetrying
+		s.Attempts = pin.Attempts
+	}
+	retries[pin.Hash] = time.AfterFunc(delay, func() {
+		defer syncJournal()
+		lock.Lock()
+		defer lock.Unlock()
+		delete(retries, pin.Hash)
+		delete(inflight, pin.Hash)
+		if pin, ok := pending[pin.Hash]; ok {
+			pinQueue.Push(pin.Hash, pin.Priority)
+			record(pin, StateQueued, "")
+		}
+	})
+}
+
+// spaceError means a pin does not fit into the space left for pins
+type spaceError struct {
+	need      uint64
+	available uint64
+}
+
+func (e *spaceError) Error() string {
+	if e.need == 0 {
+		return fmt.Sprintf("insufficient space: size unknown, %d bytes available", e.available)
+	}
+	return fmt.Sprintf("insufficient space: needs %d bytes, %d available", e.need, e.available)
+}
+
+// reject reports pin as failed because it does not fit, lock must be held
+func reject(pin Pin, err error) {
+	errlog.Printf("Reject file %s, %s\n", pin.Hash, err)
+	command.AddFailure(command.FailItem{Hash: pin.Hash, Code: command.FailNoSpace, Detail: err.Error(), Attempts: pin.Attempts})
+	finish(pin, StateFailed, err.Error())
+}
+
+// finish removes pin from the pending pins in its final state, lock must be
+// held
+func finish(pin Pin, state string, detail string) {
+	record(pin, state, detail)
+	delete(pending, pin.Hash)
+	delete(inflight, pin.Hash)
+	pinningCount--
+}
+
+// UnpinAsync queues the files of hashs for unpinning, their pins still
+// queued, waiting for a retry or running are dropped first
+func UnpinAsync(hashs []string) {
+	lock.Lock()
+	for _, hash := range hashs {
+		drop(hash)
+	}
+	lock.Unlock()
+	syncJournal()
+	for _, hash := range hashs {
+		maintenanceQueue.Push(hash)
+	}
+}
+
+// drop removes the pin of hash, a running pin is cancelled and finished by
+// its worker, lock must be held
+func drop(hash string) {
+	pin, ok := pending[hash]
+	if !ok {
+		return
+	}
+	stdlog.Printf("Drop file %s, unpin requested\n", hash)
+	if stop := running[hash]; stop != nil {
+		stop()
+		unpinned[hash] = true
+		return
+	}
+	if timer, waiting := retries[hash]; waiting {
+		timer.Stop()
+		delete(retries, hash)
+	} else {
+		pinQueue.Remove(hash)
+	}
+	finish(pin, StateUnpinned, "unpin requested")
+}
+
+// GCAsync queues a garbage collection of the repo, it runs after the unpins
+// queued before
+func GCAsync() {
+	maintenanceQueue.Push(gcTask{})
 }
 
 func PinningFileSize() uint32 {
 	return pinningCount
 }
 
+// PinService starts JobCount pinning workers and the worker for unpins and
+// garbage collections
 func PinService() {
-	for i := 0; i < JobCount; i++ {
-		go func() {
-			for {
-				hash := syncQueue.Pop()
-				var progress int64
-				err := command.GetFile(hash.(string), ioutil.Discard, func(reads int64, total int64) {
-					if (100*reads/total - progress) >= 5 {
-						progress = 100 * reads / total
-						stdlog.Printf("File: %s has downloaded %d", hash, progress)
-					}
-
-				})
-				if err != nil {
-					errlog.Printf("Get file %s failed, error: %s\n", hash, err)
-				} else {
-					stdlog.Println("Pinning file: ", hash)
-					_, err = command.PinFile(hash.(string))
-					if err != nil {
-						errlog.Printf("Pin file %s failed, error: %s\n", hash, err)
-					} else {
-						stdlog.Printf("Pin file %s successed.\n", hash)
-					}
-				}
-				lock.Lock()
-				pinningCount--
-				lock.Unlock()
+	Resize(JobCount)
+	go maintenance()
+}
+
+// Resize grows or shrinks the pinning worker pool to n workers, n is clamped
+// to [1, MaxJobCount]. Surplus workers exit once their current pin finishes.
+func Resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > MaxJobCount {
+		n = MaxJobCount
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	JobCount = n
+	for workers < JobCount {
+		workers++
+		go worker()
+	}
+}
+
+func retire() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if workers > JobCount {
+		workers--
+		return true
+	}
+	return false
+}
+
+func worker() {
+	for !retire() {
+		hash := pinQueue.Pop().(string)
+		lock.Lock()
+		// the pin may have expired or been queued again since it was popped
+		pin, ok := pending[hash]
+		if !ok || running[hash] != nil {
+			lock.Unlock()
+			continue
+		}
+		if !pin.Deadline.IsZero() && time.Now().After(pin.Deadline) {
+			expire(hash)
+			lock.Unlock()
+			syncJournal()
+			continue
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		running[hash] = stop
+		inflight[hash] = &PinStatus{Hash: hash, State: StatePinning, Attempts: pin.Attempts, Started: time.Now().Unix()}
+		lock.Unlock()
+		cancel := stop
+		if !pin.Deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, pin.Deadline)
+		}
+		size, err := admit(ctx, hash)
+		if err == nil {
+			err = download(ctx, pin)
+		}
+		cancel()
+		stop()
+		lock.Lock()
+		dropped := unpinned[hash]
+		delete(unpinned, hash)
+		delete(running, hash)
+		reserved -= size
+		var spaceErr *spaceError
+		switch {
+		case dropped:
+			finish(pin, StateUnpinned, "unpin requested")
+		case err == nil:
+			finish(pin, StateDone, "")
+		case ctx.Err() == context.DeadlineExceeded:
+			expire(hash)
+		case errors.As(err, &spaceErr):
+			reject(pin, err)
+		default:
+			retry(pin, err)
+		}
+		lock.Unlock()
+		syncJournal()
+	}
+}
+
+// admit estimates the size of the file of hash and reserves it if it fits
+// into the free space of the repo disk less config spaceMargin and into the
+// StorageMax of the repo, both less the space reserved for the other running
+// pins. It returns the reserved size or a *spaceError if the file does not
+// fit. The estimate counts the blocks the node already has too and stays
+// reserved while they are written, so it errs on the safe side. A file of
+// unknown size, or whose root block could not be fetched in time, reserves
+// nothing and is only rejected when nothing is left beyond the margin.
+func admit(ctx context.Context, hash string) (uint64, error) {
+	need, known, err := estimate(ctx, hash)
+	if err != nil || !known {
+		need = 0
+	}
+	stat, err := IPFS.GetRepoStat(ctx)
+	if err != nil {
+		return 0, err
+	}
+	free, err := IPFS.GetFreeSpace(ctx)
+	if err != nil {
+		return 0, err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	available := remaining(free, config.GetSpaceMargin()+reserved)
+	if stat.StorageMax > 0 {
+		if limit := remaining(stat.StorageMax, stat.RepoSize+reserved); limit < available {
+			available = limit
+		}
+	}
+	if need > available || available == 0 {
+		return 0, &spaceError{need, available}
+	}
+	reserved += need
+	return need, nil
+}
+
+// estimate estimates the size of the file of hash and records it in the
+// status of the running pin when known
+func estimate(ctx context.Context, hash string) (uint64, bool, error) {
+	size, known, err := IPFS.EstimateSize(ctx, hash)
+	if err != nil {
+		errlog.Printf("Estimate size of file %s failed, error: %s\n", hash, err)
+		return 0, false, err
+	}
+	if known {
+		lock.Lock()
+		if s, ok := inflight[hash]; ok {
+			s.Size = size
+		}
+		lock.Unlock()
+	}
+	return size, known, nil
+}
+
+// remaining is total less used, 0 if used exceeds it
+func remaining(total uint64, used uint64) uint64 {
+	if used > total {
+		return 0
+	}
+	return total - used
+}
+
+// progressInterval is the least time between two progress logs of a pin
+const progressInterval = 10 * time.Second
+
+// download pins the file of pin, fetching its missing blocks
+func download(ctx context.Context, pin Pin) error {
+	hash := pin.Hash
+	stdlog.Println("Pinning file: ", hash)
+	record(pin, StatePinning, "")
+	logged := time.Now()
+	_, err := IPFS.PinFile(ctx, hash, func(blocks uint64) {
+		progressed(hash, blocks)
+		if time.Since(logged) >= progressInterval {
+			logged = time.Now()
+			stdlog.Printf("File: %s has fetched %d blocks\n", hash, blocks)
+		}
+	})
+	if err != nil {
+		errlog.Printf("Pin file %s failed, error: %s\n", hash, err)
+		return err
+	}
+	stdlog.Printf("Pin file %s successed.\n", hash)
+	return nil
+}
+
+func maintenance() {
+	for {
+		switch task := maintenanceQueue.Pop().(type) {
+		case gcTask:
+			stdlog.Println("Running garbage collection of IPFS repo")
+			removed, err := IPFS.RepoGC(context.Background())
+			if err != nil {
+				errlog.Println("Garbage collection failed, error: ", err)
+				command.AddFailure(command.FailItem{Hash: "", Code: command.FailGC, Detail: err.Error()})
+			} else {
+				stdlog.Printf("Garbage collection removed %d blocks\n", removed)
+			}
+		case string:
+			stdlog.Println("Unpinning file: ", task)
+			if err := IPFS.UnpinFile(context.Background(), task); err != nil {
+				errlog.Printf("Unpin file %s failed, error: %s\n", task, err)
+				command.AddFailure(command.FailItem{Hash: task, Code: command.FailUnpin, Detail: err.Error()})
+			} else {
+				stdlog.Printf("Unpin file %s successed.\n", task)
 			}
-		}()
+		}
 	}
 }
@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// Synchronous priority queue, items of higher priority are popped first and
+// items of equal priority in push order
+type PriorityQueue struct {
+	lock    sync.Mutex
+	popable *sync.Cond
+	items   priorityHeap
+	index   map[interface{}]*priorityItem
+	seq     uint64
+	closed  bool
+}
+
+// Entry is an item of a PriorityQueue with its priority
+type Entry struct {
+	Value    interface{}
+	Priority int
+}
+
+type priorityItem struct {
+	Entry
+	seq   uint64
+	index int
+}
+
+type priorityHeap []*priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h priorityHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *priorityHeap) Push(x interface{}) {
+	item := x.(*priorityItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Create a new PriorityQueue
+func NewPriorityQueue() *PriorityQueue {
+	q := &PriorityQueue{index: make(map[interface{}]*priorityItem)}
+	q.popable = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push an item with priority to PriorityQueue, v must be comparable. An item
+// already queued keeps its place unless priority is higher than its own.
+// Returns whether v was added. Always returns immediately without blocking
+func (q *PriorityQueue) Push(v interface{}, priority int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	if item, ok := q.index[v]; ok {
+		if priority > item.Priority {
+			item.Priority = priority
+			heap.Fix(&q.items, item.index)
+		}
+		return false
+	}
+	q.seq++
+	item := &priorityItem{Entry: Entry{v, priority}, seq: q.seq}
+	heap.Push(&q.items, item)
+	q.index[v] = item
+	q.popable.Signal()
+	return true
+}
+
+// Pop the item with the highest priority from PriorityQueue, will block if
+// PriorityQueue is empty
+func (q *PriorityQueue) Pop() (v interface{}) {
+	q.lock.Lock()
+	for q.items.Len() == 0 && !q.closed {
+		q.popable.Wait()
+	}
+	if q.items.Len() > 0 {
+		item := heap.Pop(&q.items).(*priorityItem)
+		delete(q.index, item.Value)
+		v = item.Value
+	}
+	q.lock.Unlock()
+	return
+}
+
+// Remove v from PriorityQueue, returns whether it was queued
+func (q *PriorityQueue) Remove(v interface{}) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	item, ok := q.index[v]
+	if !ok {
+		return false
+	}
+	heap.Remove(&q.items, item.index)
+	delete(q.index, v)
+	return true
+}
+
+// Get the length of PriorityQueue
+func (q *PriorityQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.items.Len()
+}
+
+func (q *PriorityQueue) Has(v interface{}) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, ok := q.index[v]
+	return ok
+}
+
+// Entries returns the queued items in the order they will be popped
+func (q *PriorityQueue) Entries() []Entry {
+	q.lock.Lock()
+	items := make([]priorityItem, len(q.items))
+	for i, item := range q.items {
+		items[i] = *item
+	}
+	q.lock.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Priority != items[j].Priority {
+			return items[i].Priority > items[j].Priority
+		}
+		return items[i].seq < items[j].seq
+	})
+	entries := make([]Entry, len(items))
+	for i, item := range items {
+		entries[i] = item.Entry
+	}
+	return entries
+}
+
+func (q *PriorityQueue) Close() {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		q.popable.Broadcast()
+	}
+	q.lock.Unlock()
+}
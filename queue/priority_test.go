@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueueOrder(t *testing.T) {
+	type push struct {
+		value    string
+		priority int
+		added    bool
+	}
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string
+	}{
+		{"fifo among equal priorities", []push{{"a", 0, true}, {"b", 0, true}, {"c", 0, true}}, []string{"a", "b", "c"}},
+		{"higher priority first", []push{{"a", 0, true}, {"b", 2, true}, {"c", 1, true}}, []string{"b", "c", "a"}},
+		{"negative priority last", []push{{"a", -1, true}, {"b", 0, true}}, []string{"b", "a"}},
+		{"raise keeps push order", []push{{"a", 0, true}, {"b", 1, true}, {"a", 1, false}}, []string{"a", "b"}},
+		{"raise moves ahead", []push{{"a", 0, true}, {"b", 0, true}, {"c", 0, true}, {"c", 5, false}}, []string{"c", "a", "b"}},
+		{"lower priority is ignored", []push{{"a", 3, true}, {"b", 2, true}, {"a", 1, false}}, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		q := NewPriorityQueue()
+		for _, p := range test.pushes {
+			if added := q.Push(p.value, p.priority); added != p.added {
+				t.Errorf("%s: Push(%q, %d) = %v, want %v", test.name, p.value, p.priority, added, p.added)
+			}
+		}
+		var entries []string
+		for _, entry := range q.Entries() {
+			entries = append(entries, entry.Value.(string))
+		}
+		if !reflect.DeepEqual(entries, test.want) {
+			t.Errorf("%s: Entries() = %v, want %v", test.name, entries, test.want)
+		}
+		var popped []string
+		for q.Len() > 0 {
+			popped = append(popped, q.Pop().(string))
+		}
+		if !reflect.DeepEqual(popped, test.want) {
+			t.Errorf("%s: popped %v, want %v", test.name, popped, test.want)
+		}
+	}
+}
+
+func TestPriorityQueueRemove(t *testing.T) {
+	q := NewPriorityQueue()
+	q.Push("a", 0)
+	q.Push("b", 1)
+	q.Push("c", 2)
+	if !q.Remove("b") {
+		t.Error("Remove(b) = false, want true")
+	}
+	if q.Remove("b") {
+		t.Error("second Remove(b) = true, want false")
+	}
+	if q.Has("b") || !q.Has("a") || q.Len() != 2 {
+		t.Errorf("after Remove(b): Has(b) = %v, Has(a) = %v, Len() = %d", q.Has("b"), q.Has("a"), q.Len())
+	}
+	if v := q.Pop(); v != "c" {
+		t.Errorf("Pop() = %v, want c", v)
+	}
+	if !q.Push("b", 0) {
+		t.Error("Push of a removed item = false, want true")
+	}
+}
+
+func TestPriorityQueueClose(t *testing.T) {
+	q := NewPriorityQueue()
+	done := make(chan interface{})
+	go func() { done <- q.Pop() }()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	select {
+	case v := <-done:
+		if v != nil {
+			t.Errorf("Pop() after Close = %v, want nil", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop() still blocked after Close")
+	}
+	if q.Push("a", 0) {
+		t.Error("Push after Close = true, want false")
+	}
+}
+
+func TestPriorityQueueEntriesWhilePushing(t *testing.T) {
+	q := NewPriorityQueue()
+	for i := 0; i < 100; i++ {
+		q.Push(i, 0)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			q.Push(i, i)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if entries := q.Entries(); entries[0].Value != 99 {
+				t.Errorf("first entry %v, want 99", entries[0].Value)
+			}
+			return
+		default:
+			if entries := q.Entries(); len(entries) != 100 {
+				t.Fatalf("Entries() returned %d items, want 100", len(entries))
+			}
+		}
+	}
+}
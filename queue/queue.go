@@ -80,12 +80,12 @@ func (q *SyncQueue) Len() (l int) {
 
 func (q *SyncQueue) Has(v interface{}) bool {
 	q.lock.Lock()
+	defer q.lock.Unlock()
 	for i := 0; i < q.buffer.Length(); i++ {
 		if v == q.buffer.Get(i) {
 			return true
 		}
 	}
-	q.lock.Unlock()
 	return false
 }
 
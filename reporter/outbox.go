@@ -0,0 +1,178 @@
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"ipfs-monitor/command"
+	"os"
+	"sync"
+	"time"
+)
+
+// outboxFile holds the failures not yet acknowledged by the server, it is
+// stored in the repo next to monitor_timestamp
+const outboxFile = "monitor_outbox"
+
+// OutboxMaxEntries and OutboxMaxAge bound the outbox, the oldest failures
+// beyond them are dropped
+var (
+	OutboxMaxEntries = 10000
+	OutboxMaxAge     = 7 * 24 * time.Hour
+)
+
+var outboxLock sync.Mutex
+
+// memoryFailures holds the failures taken from command that could not be
+// written to the outbox, memoryFirst counts the failures ever removed from
+// its front. Both are guarded by outboxLock.
+var (
+	memoryFailures []command.FailItem
+	memoryFirst    uint64
+)
+
+// outboxEntry is a failure recorded at Time, Seq orders the entries
+type outboxEntry struct {
+	Seq  uint64 `json:"seq"`
+	Time int64  `json:"time"`
+	command.FailItem
+}
+
+// pendingFailures moves the failures recorded since the last report into the
+// outbox and returns every failure the server has not acknowledged yet,
+// oldest first, together with the function acknowledging them. Without a
+// writable outbox the failures are kept in memory until acknowledged.
+func pendingFailures(ctx context.Context) ([]command.FailItem, func()) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+	memoryFailures = append(memoryFailures, command.TakeFailures()...)
+	failures := memoryFailures
+	end := memoryFirst + uint64(len(failures))
+	path, err := repoPath(ctx)
+	var entries []outboxEntry
+	if err == nil {
+		entries, err = stashFailures(path, failures)
+	}
+	if err != nil {
+		errlog.Println("Write outbox failed, keep failures in memory, error: ", err)
+		return failures, func() {
+			outboxLock.Lock()
+			dropMemory(end)
+			outboxLock.Unlock()
+		}
+	}
+	dropMemory(end)
+	items := make([]command.FailItem, len(entries))
+	for i, entry := range entries {
+		items[i] = entry.FailItem
+	}
+	if len(entries) == 0 {
+		return items, func() {}
+	}
+	seq := entries[len(entries)-1].Seq
+	return items, func() {
+		outboxLock.Lock()
+		defer outboxLock.Unlock()
+		if err := ackFailures(path, seq); err != nil {
+			errlog.Println("Write outbox failed, failures will be reported again, error: ", err)
+		}
+	}
+}
+
+// dropMemory removes the failures before end, counted like memoryFirst, from
+// memoryFailures. Failures already removed by another report, acknowledged or
+// written to the outbox, are skipped.
+func dropMemory(end uint64) {
+	if end <= memoryFirst {
+		return
+	}
+	n := end - memoryFirst
+	if n > uint64(len(memoryFailures)) {
+		n = uint64(len(memoryFailures))
+	}
+	memoryFailures = memoryFailures[n:]
+	memoryFirst += n
+}
+
+// stashFailures appends failures to the outbox at path and returns its
+// entries within OutboxMaxEntries and OutboxMaxAge
+func stashFailures(path string, failures []command.FailItem) ([]outboxEntry, error) {
+	entries, err := readOutbox(path)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64
+	if len(entries) > 0 {
+		seq = entries[len(entries)-1].Seq
+	}
+	now := time.Now()
+	for _, failure := range failures {
+		seq++
+		entries = append(entries, outboxEntry{seq, now.Unix(), failure})
+	}
+	first := 0
+	for first < len(entries) && now.Sub(time.Unix(entries[first].Time, 0)) > OutboxMaxAge {
+		first++
+	}
+	if len(entries)-first > OutboxMaxEntries {
+		first = len(entries) - OutboxMaxEntries
+	}
+	if first > 0 {
+		errlog.Printf("Drop %d failures from outbox, older than %s or beyond %d entries\n", first, OutboxMaxAge, OutboxMaxEntries)
+		entries = entries[first:]
+	}
+	if len(failures) > 0 || first > 0 {
+		if err := writeOutbox(path, entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// ackFailures removes the entries up to seq from the outbox at path
+func ackFailures(path string, seq uint64) error {
+	entries, err := readOutbox(path)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for i < len(entries) && entries[i].Seq <= seq {
+		i++
+	}
+	return writeOutbox(path, entries[i:])
+}
+
+func readOutbox(path string) ([]outboxEntry, error) {
+	content, err := ioutil.ReadFile(path + "/" + outboxFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []outboxEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func writeOutbox(path string, entries []outboxEntry) error {
+	file := path + "/" + outboxFile
+	if len(entries) == 0 {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
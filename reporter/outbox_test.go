@@ -0,0 +1,149 @@
+package reporter
+
+import (
+	"io/ioutil"
+	"ipfs-monitor/command"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func failures(hashes ...string) []command.FailItem {
+	items := make([]command.FailItem, len(hashes))
+	for i, hash := range hashes {
+		items[i] = command.FailItem{Hash: hash, Code: command.FailNoSpace}
+	}
+	return items
+}
+
+func outboxHashes(entries []outboxEntry) []string {
+	var hashes []string
+	for _, entry := range entries {
+		hashes = append(hashes, entry.Hash)
+	}
+	return hashes
+}
+
+func TestStashFailures(t *testing.T) {
+	defer func(entries int, age time.Duration) {
+		OutboxMaxEntries, OutboxMaxAge = entries, age
+	}(OutboxMaxEntries, OutboxMaxAge)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+
+	tests := []struct {
+		name       string
+		outbox     []outboxEntry
+		failures   []command.FailItem
+		maxEntries int
+		want       []string
+		wantSeq    []uint64
+	}{
+		{"empty outbox", nil, failures("QmA", "QmB"), 10, []string{"QmA", "QmB"}, []uint64{1, 2}},
+		{"nothing to stash", nil, nil, 10, nil, nil},
+		{"sequence continues", []outboxEntry{{Seq: 7, Time: time.Now().Unix(), FailItem: failures("QmA")[0]}},
+			failures("QmB"), 10, []string{"QmA", "QmB"}, []uint64{7, 8}},
+		{"oldest beyond max entries dropped", nil, failures("QmA", "QmB", "QmC"), 2, []string{"QmB", "QmC"}, []uint64{2, 3}},
+		{"older than max age dropped", []outboxEntry{{Seq: 1, Time: old, FailItem: failures("QmA")[0]}},
+			failures("QmB"), 10, []string{"QmB"}, []uint64{2}},
+	}
+	for _, test := range tests {
+		repo, err := ioutil.TempDir("", "ipfs-repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		OutboxMaxEntries, OutboxMaxAge = test.maxEntries, time.Hour
+		if err := writeOutbox(repo, test.outbox); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := stashFailures(repo, test.failures)
+		if err != nil {
+			t.Errorf("%s: stashFailures failed: %s", test.name, err)
+			os.RemoveAll(repo)
+			continue
+		}
+		var seqs []uint64
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		if hashes := outboxHashes(entries); !reflect.DeepEqual(hashes, test.want) || !reflect.DeepEqual(seqs, test.wantSeq) {
+			t.Errorf("%s: stashFailures = %v %v, want %v %v", test.name, hashes, seqs, test.want, test.wantSeq)
+		}
+		stored, err := readOutbox(repo)
+		if err != nil || !reflect.DeepEqual(stored, entries) {
+			t.Errorf("%s: outbox holds %v, %v, want %v", test.name, stored, err, entries)
+		}
+		os.RemoveAll(repo)
+	}
+}
+
+func TestAckFailures(t *testing.T) {
+	tests := []struct {
+		seq  uint64
+		want []string
+	}{
+		{0, []string{"QmA", "QmB", "QmC"}},
+		{2, []string{"QmC"}},
+		{3, nil},
+		{9, nil},
+	}
+	for _, test := range tests {
+		repo, err := ioutil.TempDir("", "ipfs-repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stashFailures(repo, failures("QmA", "QmB", "QmC")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ackFailures(repo, test.seq); err != nil {
+			t.Errorf("ackFailures(%d) failed: %s", test.seq, err)
+		}
+		entries, err := readOutbox(repo)
+		if err != nil {
+			t.Errorf("ackFailures(%d) left an unreadable outbox: %s", test.seq, err)
+		}
+		if hashes := outboxHashes(entries); !reflect.DeepEqual(hashes, test.want) {
+			t.Errorf("ackFailures(%d) kept %v, want %v", test.seq, hashes, test.want)
+		}
+		if _, err := os.Stat(repo + "/" + outboxFile); test.want == nil && !os.IsNotExist(err) {
+			t.Errorf("ackFailures(%d) kept the outbox file, want it removed", test.seq)
+		}
+		os.RemoveAll(repo)
+	}
+}
+
+func TestDropMemory(t *testing.T) {
+	defer func() { memoryFailures, memoryFirst = nil, 0 }()
+	tests := []struct {
+		name  string
+		takes []int
+		drops []int
+		want  []string
+		first uint64
+	}{
+		{"ack in order", []int{2, 3}, []int{0, 1}, nil, 3},
+		{"later report written to the outbox first", []int{2, 3}, []int{1, 0}, nil, 3},
+		{"same report acked twice", []int{2}, []int{0, 0}, nil, 2},
+		{"failures after the report are kept", []int{1, 3}, []int{0}, []string{"QmB", "QmC"}, 1},
+	}
+	for _, test := range tests {
+		memoryFailures, memoryFirst = nil, 0
+		// report i takes the first takes[i] failures, dropping ends[i] acks it
+		all := failures("QmA", "QmB", "QmC")
+		var ends []uint64
+		for _, n := range test.takes {
+			memoryFailures = append(memoryFailures, all[memoryFirst+uint64(len(memoryFailures)):n]...)
+			ends = append(ends, memoryFirst+uint64(len(memoryFailures)))
+		}
+		for _, i := range test.drops {
+			dropMemory(ends[i])
+		}
+		var hashes []string
+		for _, failure := range memoryFailures {
+			hashes = append(hashes, failure.Hash)
+		}
+		if !reflect.DeepEqual(hashes, test.want) || memoryFirst != test.first {
+			t.Errorf("%s: memory holds %v from %d, want %v from %d", test.name, hashes, memoryFirst, test.want, test.first)
+		}
+	}
+}
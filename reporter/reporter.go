@@ -2,19 +2,37 @@ package reporter
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"ipfs-monitor/command"
+	"ipfs-monitor/config"
 	"ipfs-monitor/pinner"
 	"ipfs-monitor/signer"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var Report_URL string
+// IPFS is the node whose status is reported
+var IPFS *command.Client
+
+var report_URL string
+var urlLock sync.RWMutex
+
+var lastRepoPath string
+var repoLock sync.Mutex
+
+// PageSize is the maximum number of pinned files in one report request
+var PageSize = 1000
 
 var stdlog, errlog *log.Logger
 
@@ -24,24 +42,61 @@ type Request struct {
 	PublicKey string       `json:"publickey"`
 }
 
+// RequestData is one page of a report, pinned files are split over pages of
+// up to PageSize files sharing the ReportID. Only the last page carries the
+// fail list and the pins and only its response is acted upon. A full report
+// lists every pinned file in PinnedFiles, a delta report the files pinned and
+// unpinned since the report the server acknowledged with LastTimestamp.
 type RequestData struct {
 	NodeExternalID  string             `json:"node_external_id"`
+	NodeStatus      string             `json:"node_status"`
+	ReportID        string             `json:"report_id"`
+	Page            int                `json:"page"`
+	LastPage        bool               `json:"last_page"`
+	Mode            string             `json:"mode"`
 	PinnedFiles     []Item             `json:"pinned_files"`
+	AddedFiles      []Item             `json:"added_files"`
+	RemovedFiles    []string           `json:"removed_files"`
 	PinningFileSize uint32             `json:"pinning_file_size"`
 	AvailableSpace  uint64             `json:"available_space"`
 	Throughput      uint64             `json:"throughput"`
 	LastTimestamp   uint64             `json:"last_timestamp"`
 	FailList        []command.FailItem `json:"fail_list"`
+	PinQueue        []pinner.QueuedPin `json:"pin_queue"`
+	PinStatus       []pinner.PinStatus `json:"pin_status"`
 }
 
+// States of the IPFS node in RequestData.NodeStatus
+const (
+	NodeUp   = "up"
+	NodeDown = "down"
+)
+
+// Kinds of reports in RequestData.Mode, reports of a down node carry no pin
+// information
+const (
+	ReportFull  = "full"
+	ReportDelta = "delta"
+	ReportNone  = "none"
+)
+
+// Item is a pinned file, Size is its content size and DiskSize the size of
+// all its blocks
 type Item struct {
-	ID   string `json:"id"`
-	Size uint64 `json:"size"`
+	ID       string `json:"id"`
+	Size     uint64 `json:"size"`
+	DiskSize uint64 `json:"disk_size"`
 }
 
 type Response struct {
-	PinHash          []string `json:"pin_hash"`
-	CurrentTimestamp uint64   `json:"current_timestamp"`
+	ReportID         string       `json:"report_id"`
+	Page             int          `json:"page"`
+	PinHash          []string     `json:"pin_hash"`
+	CurrentTimestamp uint64       `json:"current_timestamp"`
+	FullResync       bool         `json:"full_resync"`
+	Pins             []PinRequest `json:"pins"`
+	UnpinHash        []string     `json:"unpin_hash"`
+	RepoGC           bool         `json:"repo_gc"`
 }
 
 func init() {
@@ -64,123 +119,377 @@ func init() {
 	// httpClient = &http.Client{Transport: &defaultTransport}
 }
 
+// SetReportURL switches the server URL used by later reports
+func SetReportURL(url string) {
+	urlLock.Lock()
+	report_URL = url
+	urlLock.Unlock()
+}
+
+// ReportURL returns the server URL for reporting status
+func ReportURL() string {
+	urlLock.RLock()
+	defer urlLock.RUnlock()
+	return report_URL
+}
+
 func Report() ([]byte, error) {
 	stdlog.Println("Prepare information of IPFS node for reporting status to server...")
-	node_external_id, err := command.GetPeerID()
+	ctx := context.Background()
+	node_external_id, err := IPFS.GetPeerID(ctx)
 	if err != nil {
 		errlog.Println("Get peer ID failed, error: ", err)
-		return nil, err
+		return abort(ctx, err)
 	}
-	publickey, err := command.GetPubKey()
+	publickey, err := IPFS.GetPubKey(ctx)
 	if err != nil {
 		errlog.Println("Get public key failed, error: ", err)
-		return nil, err
-	}
-	keys, sizes, err := command.GetPinedList()
-	if err != nil {
-		errlog.Println("Get pined file list failed, error: ", err)
-		return nil, err
-	}
-	items := make([]Item, len(keys))
-	for i, key := range keys {
-		size := sizes[key]
-		items[i] = Item{ID: key, Size: size}
+		return abort(ctx, err)
 	}
 	pinningFileSize := pinner.PinningFileSize()
-	available_space, err := command.GetFreeSpace()
+	available_space, err := IPFS.GetFreeSpace(ctx)
 	if err != nil {
 		errlog.Println("Get free space failed, error: ", err)
-		return nil, err
+		return abort(ctx, err)
 	}
-	throughput, err := command.GetThroughput()
+	throughput, err := IPFS.GetThroughput(ctx)
 	if err != nil {
 		errlog.Println("Get throughput failed, error: ", err)
-		return nil, err
+		return abort(ctx, err)
 	}
-	timestampstr, err := readTimestamp()
+	timestampstr, err := readTimestamp(ctx)
 	if err != nil {
 		errlog.Println("Read timestamp failed, error: ", err)
-		return nil, err
+		return abort(ctx, err)
 	}
 	timestamp, _ := strconv.ParseUint(timestampstr, 10, 64)
 
+	path, err := repoPath(ctx)
+	if err != nil {
+		errlog.Println("Get repo path failed, error: ", err)
+		return abort(ctx, err)
+	}
+	now := time.Now().Unix()
+	base := loadSnapshot(node_external_id, path, timestamp, config.GetFullReportInterval())
+	p := &pager{ctx: ctx, publicKey: publickey, send: send, data: RequestData{
+		NodeExternalID:  node_external_id,
+		NodeStatus:      NodeUp,
+		ReportID:        newReportID(),
+		Mode:            ReportFull,
+		PinningFileSize: pinningFileSize,
+		AvailableSpace:  available_space,
+		Throughput:      throughput,
+		LastTimestamp:   timestamp,
+	}}
+	if base != nil {
+		p.data.Mode = ReportDelta
+	}
+	p.reset()
+	pinned := make(map[string]bool)
+	err = pinnedItems(ctx, node_external_id, path, func(items []Item, last bool) error {
+		return p.collect(base, pinned, items, last)
+	})
+	if p.err != nil {
+		return nil, p.err
+	}
+	if err != nil {
+		errlog.Println("Get pined file list failed, error: ", err)
+		return abort(ctx, err)
+	}
+	if err := acknowledge(node_external_id, path, base, now, pinned, p.response); err != nil {
+		errlog.Println("Write snapshot failed, next report is a full one, error: ", err)
+		dropSnapshot(path)
+	}
+	return p.json, nil
+}
+
+// pager splits the pin information of one report into pages of up to
+// PageSize files and sends them with send
+type pager struct {
+	ctx       context.Context
+	publicKey string
+	send      func(ctx context.Context, request *Request) ([]byte, *Response, error)
+	data      RequestData
+	files     int
+	json      []byte
+	response  *Response
+	err       error
+}
+
+// collect adds one page of the pinned files to the report: every file to a
+// full report and the files missing from base to a delta report. After the
+// last page the files of base no longer pinned are added as removed and the
+// report is sent. pinned collects the pinned files.
+func (p *pager) collect(base *snapshot, pinned map[string]bool, items []Item, last bool) error {
+	for _, item := range items {
+		pinned[item.ID] = true
+		if base == nil {
+			if err := p.pinned(item); err != nil {
+				return err
+			}
+		} else if !base.pinned[item.ID] {
+			if err := p.added(item); err != nil {
+				return err
+			}
+		}
+	}
+	if !last {
+		return nil
+	}
+	if base != nil {
+		var removed []string
+		for id := range base.pinned {
+			if !pinned[id] {
+				removed = append(removed, id)
+			}
+		}
+		sort.Strings(removed)
+		for _, id := range removed {
+			if err := p.removed(id); err != nil {
+				return err
+			}
+		}
+	}
+	return p.flush(true)
+}
+
+func (p *pager) pinned(item Item) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	p.data.PinnedFiles = append(p.data.PinnedFiles, item)
+	return nil
+}
+
+func (p *pager) added(item Item) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	p.data.AddedFiles = append(p.data.AddedFiles, item)
+	return nil
+}
+
+func (p *pager) removed(id string) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	p.data.RemovedFiles = append(p.data.RemovedFiles, id)
+	return nil
+}
+
+// next makes room for one more file, sending the current page when it is
+// full
+func (p *pager) next() error {
+	if p.files < PageSize {
+		p.files++
+		return nil
+	}
+	if err := p.flush(false); err != nil {
+		return err
+	}
+	p.files++
+	return nil
+}
+
+// flush sends the current page and starts the next one
+func (p *pager) flush(last bool) error {
+	p.data.Page++
+	p.data.LastPage = last
+	data := p.data
+	p.reset()
+	p.json, p.response, p.err = p.send(p.ctx, &Request{Data: &data, PublicKey: p.publicKey})
+	return p.err
+}
+
+func (p *pager) reset() {
+	p.data.PinnedFiles = []Item{}
+	p.data.AddedFiles = []Item{}
+	p.data.RemovedFiles = []string{}
+	p.files = 0
+}
+
+// abort ends a report cycle after a failed IPFS call. When the circuit
+// breaker considers the node down this is reported to the server instead.
+func abort(ctx context.Context, err error) ([]byte, error) {
+	if !IPFS.Down() {
+		return nil, err
+	}
+	errlog.Println("IPFS node is down, reporting node status down")
+	// without a known repo path the server still learns that the node is down
+	timestampstr, err := readTimestamp(ctx)
+	if err != nil {
+		errlog.Println("Read timestamp failed, reporting last timestamp 0, error: ", err)
+		timestampstr = "0"
+	}
+	timestamp, _ := strconv.ParseUint(timestampstr, 10, 64)
 	request := &Request{
 		Data: &RequestData{
-			NodeExternalID:  node_external_id,
-			PinnedFiles:     items,
-			PinningFileSize: pinningFileSize,
-			AvailableSpace:  available_space,
-			Throughput:      throughput,
+			NodeExternalID:  signer.PeerID(),
+			NodeStatus:      NodeDown,
+			ReportID:        newReportID(),
+			Page:            1,
+			LastPage:        true,
+			Mode:            ReportNone,
+			PinningFileSize: pinner.PinningFileSize(),
 			LastTimestamp:   timestamp,
-			FailList:        command.FailList,
 		},
-		Signature: "",
-		PublicKey: publickey,
+		PublicKey: signer.PublicKey(),
+	}
+	requestJson, _, err := send(ctx, request)
+	return requestJson, err
+}
+
+// send signs and posts request, then handles the response of the server to
+// the last page of a report. The last page carries the pin queue, the status
+// of the in-flight pins and the failures from the outbox, they are removed
+// once the server answered.
+func send(ctx context.Context, request *Request) ([]byte, *Response, error) {
+	ack := func() {}
+	if request.Data.LastPage {
+		pinner.DropExpired()
+		request.Data.PinQueue = pinner.Queued(PageSize)
+		request.Data.PinStatus = pinner.Status()
+		request.Data.FailList, ack = pendingFailures(ctx)
 	}
 	dataJson, err := json.Marshal(request.Data)
-	command.FailList = nil //reset failList
 	if err != nil {
 		errlog.Println("Report status to server failed, error: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 	signature, err := signer.Sign(string(dataJson[:]))
 	if err != nil {
 		errlog.Println("Report status to server failed, error: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 	request.Signature = hex.EncodeToString(signature)
 	requestJson, err := json.Marshal(request)
 	if err != nil {
 		errlog.Println("Report status to server failed, error: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 	stdlog.Println("Ready for report IPFS node status: ", string(requestJson))
-	responseJson, err := doBytesPost(Report_URL, requestJson)
+	responseJson, responseSignature, err := doBytesPost(ReportURL(), requestJson)
 	if err != nil {
 		errlog.Println("Report status to server failed, error: ", err)
-		return nil, err
+		return nil, nil, err
+	}
+	if err := verifyResponse(responseJson, responseSignature); err != nil {
+		errlog.Println("Reject response from server, error: ", err)
+		return nil, nil, err
 	}
 	stdlog.Println("Sending status successful, retrieving response from server: ", string(responseJson))
-	var response Response
-	if err := json.NewDecoder(bytes.NewReader(responseJson)).Decode(&response); err != nil {
+	response, err := decodeResponse(responseJson, request.Data.ReportID, request.Data.Page)
+	if err != nil {
 		errlog.Println("Decode response from server failed, error: ", err)
-		return nil, err
+		return nil, nil, err
 	}
-	if writeTimestamp(strconv.FormatUint(response.CurrentTimestamp, 10)) != nil {
+	if !request.Data.LastPage {
+		return requestJson, response, nil
+	}
+	timestampstr, err := readTimestamp(ctx)
+	if err != nil {
+		errlog.Println("Read timestamp failed, error: ", err)
+		return nil, nil, err
+	}
+	timestamp, _ := strconv.ParseUint(timestampstr, 10, 64)
+	if response.CurrentTimestamp < timestamp {
+		err := fmt.Errorf("Invalid response from server: current_timestamp %d is before last timestamp %d", response.CurrentTimestamp, timestamp)
+		errlog.Println("Reject response from server, error: ", err)
+		return nil, nil, err
+	}
+	ack()
+	if err := writeTimestamp(ctx, strconv.FormatUint(response.CurrentTimestamp, 10)); err != nil {
 		errlog.Println("Write timestamp failed, error: ", err)
-		return nil, err
+		return nil, nil, err
+	}
+	pinner.PinAsync(pinRequests(response))
+	pinner.UnpinAsync(validPins(response.UnpinHash))
+	if response.RepoGC {
+		pinner.GCAsync()
 	}
-	pinner.PinAsync(response.PinHash)
-	return requestJson, nil
+	return requestJson, response, nil
+}
 
+// pinnedItems passes the pinned files of the node peerID with its repo at
+// path to fn in pages of up to PageSize, only sizes missing from the size
+// cache are calculated. Files whose size the node could not calculate are
+// reported with size 0.
+func pinnedItems(ctx context.Context, peerID string, path string, fn func(items []Item, last bool) error) error {
+	sizeLock.Lock()
+	defer sizeLock.Unlock()
+	cache := loadSizes(peerID, path)
+	err := IPFS.GetPinedList(ctx, cache.Sizes, PageSize, func(keys []string, last bool) error {
+		items := make([]Item, len(keys))
+		for i, key := range keys {
+			size, ok := cache.Sizes[key]
+			if !ok {
+				errlog.Printf("Calculate size of file %s failed, report it with size 0\n", key)
+			}
+			items[i] = Item{ID: key, Size: size.Logical, DiskSize: size.Disk}
+		}
+		return fn(items, last)
+	})
+	// sizes calculated before an error are kept for the next cycle
+	if err := saveSizes(cache); err != nil {
+		errlog.Println("Write size cache failed, error: ", err)
+	}
+	return err
 }
 
-func doBytesPost(url string, data []byte) ([]byte, error) {
+// newReportID identifies the pages of one report
+func newReportID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
 
-	body := bytes.NewReader(data)
-	request, err := http.NewRequest("POST", url, body)
+// doBytesPost posts data to url and returns the response body with its
+// signature, non-2xx responses are returned as StatusError
+func doBytesPost(url string, data []byte) ([]byte, string, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(data))
 	if err != nil {
-		//errlog.Println("http.NewRequest,[err=%s][url=%s]", err, url)
-		return []byte(""), err
+		return nil, "", err
 	}
 	request.Header.Set("Connection", "Keep-Alive")
-	var resp *http.Response
-	resp, err = http.DefaultClient.Do(request)
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		//errlog.Println("http.Do failed,[err=%s][url=%s]", err, url)
-		return []byte(""), err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", &StatusError{resp.StatusCode, resp.Status, excerpt(body)}
+	}
+	return body, strings.TrimSpace(resp.Header.Get(SignatureHeader)), nil
+}
+
+// SetRepoPath tells the repo path of the IPFS node known before the first
+// report, it is used while the node is down
+func SetRepoPath(path string) {
+	repoLock.Lock()
+	lastRepoPath = path
+	repoLock.Unlock()
+}
+
+// repoPath asks the node for its repo path, the last known path is used
+// while the node is down
+func repoPath(ctx context.Context) (string, error) {
+	path, err := IPFS.GetRepoPath(ctx)
+	repoLock.Lock()
+	defer repoLock.Unlock()
 	if err != nil {
-		//errlog.Println("http.Do failed,[err=%s][url=%s]", err, url)
-		return []byte(""), err
+		if IPFS.Down() && lastRepoPath != "" {
+			return lastRepoPath, nil
+		}
+		return "", err
 	}
-	return b, err
+	lastRepoPath = path
+	return path, nil
 }
 
-func readTimestamp() (string, error) {
-	timestamp_path, err := command.GetRepoPath()
+func readTimestamp(ctx context.Context) (string, error) {
+	timestamp_path, err := repoPath(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -195,8 +504,8 @@ func readTimestamp() (string, error) {
 	return string(content), nil
 }
 
-func writeTimestamp(timestamp string) error {
-	timestamp_path, err := command.GetRepoPath()
+func writeTimestamp(ctx context.Context, timestamp string) error {
+	timestamp_path, err := repoPath(ctx)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,141 @@
+package reporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ipfs-monitor/command"
+	"ipfs-monitor/config"
+	"ipfs-monitor/pinner"
+	"ipfs-monitor/verifier"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// SignatureHeader carries the hex encoded signature of the response body,
+// made with the key of the report server
+const SignatureHeader = "X-Signature"
+
+// maxResponseSize bounds the response of the report server
+const maxResponseSize = 16 << 20
+
+// maxExcerpt bounds the part of an error response kept in StatusError
+const maxExcerpt = 256
+
+// StatusError is returned when the report server answers with a non-2xx
+// status, Body is the beginning of the response
+type StatusError struct {
+	Code   int
+	Status string
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("Report server answered %s", e.Status)
+	}
+	return fmt.Sprintf("Report server answered %s: %s", e.Status, e.Body)
+}
+
+// excerpt turns the beginning of body into a single line for error messages
+func excerpt(body []byte) string {
+	if len(body) > maxExcerpt {
+		body = body[:maxExcerpt]
+		for len(body) > 0 && !utf8.Valid(body) {
+			body = body[:len(body)-1]
+		}
+		return strings.Join(strings.Fields(string(body)), " ") + "..."
+	}
+	return strings.Join(strings.Fields(string(body)), " ")
+}
+
+// decodeResponse decodes the response of the report server to page of the
+// report reportID. The response has to echo both so that a signed response
+// cannot be replayed as the answer to another request.
+func decodeResponse(body []byte, reportID string, page int) (*Response, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("Invalid response from server: %s: %s", err, excerpt(body))
+	}
+	for _, name := range []string{"report_id", "page", "pin_hash", "current_timestamp"} {
+		if value, ok := fields[name]; !ok || string(value) == "null" {
+			return nil, fmt.Errorf("Invalid response from server: missing %s", name)
+		}
+	}
+	var response Response
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("Invalid response from server: %s", err)
+	}
+	if response.ReportID != reportID || response.Page != page {
+		return nil, fmt.Errorf("Invalid response from server: answers page %d of report %q instead of page %d of report %q", response.Page, response.ReportID, page, reportID)
+	}
+	return &response, nil
+}
+
+// verifyResponse checks the signature of the response body against the
+// server public key, responses are rejected when there is no key
+func verifyResponse(body []byte, signature string) error {
+	pubkey := config.GetServerPubKey()
+	if pubkey == "" {
+		return errors.New("No public key of the report server, set serverPubKey")
+	}
+	if signature == "" {
+		return errors.New("Response from server is not signed")
+	}
+	if err := verifier.Check(pubkey, string(body), signature); err != nil {
+		return fmt.Errorf("Verify response signature failed: %s", err)
+	}
+	return nil
+}
+
+// PinRequest is a file the server asks to pin with its priority, higher
+// first, and deadline in seconds since the epoch, 0 for none
+type PinRequest struct {
+	Hash     string `json:"hash"`
+	Priority int    `json:"priority"`
+	Deadline int64  `json:"deadline"`
+}
+
+// pinRequests collects the pins of response, PinHash entries get priority 0
+// and no deadline
+func pinRequests(response *Response) []pinner.Pin {
+	var pins []pinner.Pin
+	for _, hash := range validPins(response.PinHash) {
+		pins = append(pins, pinner.Pin{Hash: hash})
+	}
+	for _, request := range response.Pins {
+		if !validCID(request.Hash) {
+			continue
+		}
+		pin := pinner.Pin{Hash: request.Hash, Priority: request.Priority}
+		if request.Deadline > 0 {
+			pin.Deadline = time.Unix(request.Deadline, 0)
+		}
+		pins = append(pins, pin)
+	}
+	return pins
+}
+
+// validPins drops the entries of pins that are no CIDs
+func validPins(pins []string) []string {
+	valid := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		if validCID(pin) {
+			valid = append(valid, pin)
+		}
+	}
+	return valid
+}
+
+// validCID tells whether hash is a CID, invalid ones are reported as failures
+func validCID(hash string) bool {
+	if _, err := cid.Decode(hash); err != nil {
+		errlog.Printf("Ignore invalid CID %q from server, error: %s\n", hash, err)
+		command.AddFailure(command.FailItem{Hash: hash, Code: command.FailInvalidCID, Detail: "invalid cid"})
+		return false
+	}
+	return true
+}
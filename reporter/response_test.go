@@ -0,0 +1,38 @@
+package reporter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"valid", `{"report_id":"r1","page":2,"pin_hash":["QmA"],"current_timestamp":5}`, ""},
+		{"empty pin_hash", `{"report_id":"r1","page":2,"pin_hash":[],"current_timestamp":0}`, ""},
+		{"not json", `<html>bad gateway</html>`, "Invalid response from server"},
+		{"not an object", `[]`, "Invalid response from server"},
+		{"missing report_id", `{"page":2,"pin_hash":[],"current_timestamp":5}`, "missing report_id"},
+		{"missing page", `{"report_id":"r1","pin_hash":[],"current_timestamp":5}`, "missing page"},
+		{"null pin_hash", `{"report_id":"r1","page":2,"pin_hash":null,"current_timestamp":5}`, "missing pin_hash"},
+		{"missing current_timestamp", `{"report_id":"r1","page":2,"pin_hash":[]}`, "missing current_timestamp"},
+		{"wrong type", `{"report_id":"r1","page":2,"pin_hash":"QmA","current_timestamp":5}`, "Invalid response from server"},
+		{"other report", `{"report_id":"r0","page":2,"pin_hash":[],"current_timestamp":5}`, "instead of page 2"},
+		{"other page", `{"report_id":"r1","page":1,"pin_hash":[],"current_timestamp":5}`, "instead of page 2"},
+	}
+	for _, test := range tests {
+		response, err := decodeResponse([]byte(test.body), "r1", 2)
+		if test.err == "" {
+			if err != nil || response == nil {
+				t.Errorf("%s: decodeResponse failed: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: decodeResponse error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
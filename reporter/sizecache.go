@@ -0,0 +1,65 @@
+package reporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"ipfs-monitor/command"
+	"os"
+	"sync"
+)
+
+// sizeCacheFile holds the sizes of pinned files between report cycles, it is
+// stored in the repo next to monitor_timestamp
+const sizeCacheFile = "monitor_sizes"
+
+// sizeCache is the CID to size cache of the node PeerID with its repo at
+// RepoPath, it is dropped when either changes
+type sizeCache struct {
+	PeerID   string                  `json:"peer_id"`
+	RepoPath string                  `json:"repo_path"`
+	Sizes    map[string]command.Size `json:"sizes"`
+}
+
+var sizes *sizeCache
+var sizeLock sync.Mutex
+
+// loadSizes returns the cached sizes of the node peerID with its repo at path,
+// read from the repo on first use or after the repo changed
+func loadSizes(peerID string, path string) *sizeCache {
+	if sizes != nil && sizes.PeerID == peerID && sizes.RepoPath == path {
+		return sizes
+	}
+	sizes = &sizeCache{PeerID: peerID, RepoPath: path, Sizes: make(map[string]command.Size)}
+	content, err := ioutil.ReadFile(path + "/" + sizeCacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errlog.Println("Read size cache failed, error: ", err)
+		}
+		return sizes
+	}
+	var cached sizeCache
+	if err := json.Unmarshal(content, &cached); err != nil {
+		errlog.Println("Decode size cache failed, error: ", err)
+		return sizes
+	}
+	if cached.PeerID != peerID || cached.RepoPath != path || cached.Sizes == nil {
+		stdlog.Println("IPFS repo changed, drop size cache")
+		return sizes
+	}
+	sizes = &cached
+	return sizes
+}
+
+// saveSizes writes the cache to the repo it belongs to
+func saveSizes(cache *sizeCache) error {
+	content, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	path := cache.RepoPath + "/" + sizeCacheFile
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
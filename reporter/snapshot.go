@@ -0,0 +1,103 @@
+package reporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// snapshotFile holds the pin set of the last report acknowledged by the
+// server, it is stored in the repo next to monitor_timestamp
+const snapshotFile = "monitor_snapshot"
+
+// snapshot is the pin set of the node PeerID with its repo at RepoPath as
+// acknowledged by the server with Timestamp, FullTime is the time of the last
+// full report
+type snapshot struct {
+	PeerID    string   `json:"peer_id"`
+	RepoPath  string   `json:"repo_path"`
+	Timestamp uint64   `json:"timestamp"`
+	FullTime  int64    `json:"full_time"`
+	Pins      []string `json:"pins"`
+	pinned    map[string]bool
+}
+
+// loadSnapshot reads the snapshot a delta report of the node peerID with its
+// repo at path is based on. It returns nil when a full report is due: there
+// is no snapshot, it belongs to another node or repo, it was not acknowledged
+// with timestamp or the last full report is older than interval.
+func loadSnapshot(peerID string, path string, timestamp uint64, interval time.Duration) *snapshot {
+	if interval <= 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path + "/" + snapshotFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errlog.Println("Read snapshot failed, error: ", err)
+		}
+		return nil
+	}
+	var s snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		errlog.Println("Decode snapshot failed, error: ", err)
+		return nil
+	}
+	if s.PeerID != peerID || s.RepoPath != path || s.Timestamp != timestamp {
+		return nil
+	}
+	if time.Since(time.Unix(s.FullTime, 0)) >= interval {
+		return nil
+	}
+	s.pinned = make(map[string]bool, len(s.Pins))
+	for _, pin := range s.Pins {
+		s.pinned[pin] = true
+	}
+	s.Pins = nil
+	return &s
+}
+
+// saveSnapshot writes the pin set pinned as acknowledged with timestamp
+func saveSnapshot(peerID string, path string, timestamp uint64, fullTime int64, pinned map[string]bool) error {
+	s := snapshot{PeerID: peerID, RepoPath: path, Timestamp: timestamp, FullTime: fullTime}
+	s.Pins = make([]string, 0, len(pinned))
+	for pin := range pinned {
+		s.Pins = append(s.Pins, pin)
+	}
+	sort.Strings(s.Pins)
+	content, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	file := path + "/" + snapshotFile
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// acknowledge keeps the pin set pinned the server acknowledged with response
+// as the base of the next delta report, or drops it when the server asked for
+// a full resync. fullTime is the start of the report when it was a full one,
+// a delta report on base keeps the time of the full report base goes back to.
+func acknowledge(peerID string, path string, base *snapshot, fullTime int64, pinned map[string]bool, response *Response) error {
+	if response.FullResync {
+		stdlog.Println("Server requested full resync")
+		return dropSnapshot(path)
+	}
+	if base != nil {
+		fullTime = base.FullTime
+	}
+	return saveSnapshot(peerID, path, response.CurrentTimestamp, fullTime, pinned)
+}
+
+// dropSnapshot makes the next report a full one
+func dropSnapshot(path string) error {
+	err := os.Remove(path + "/" + snapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package reporter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func pinSet(ids ...string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func sortedPins(set map[string]bool) []string {
+	var ids []string
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	repo, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	moved, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	empty, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	broken, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(broken)
+	ioutil.WriteFile(broken+"/"+snapshotFile, []byte(`{"peer_id":`), 0644)
+
+	recent := time.Now().Add(-10 * time.Minute).Unix()
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	tests := []struct {
+		name      string
+		fullTime  int64
+		peerID    string
+		path      string
+		timestamp uint64
+		interval  time.Duration
+		want      []string
+	}{
+		{"delta report due", recent, "QmPeer", repo, 7, time.Hour, []string{"QmA", "QmB"}},
+		{"full reports only", recent, "QmPeer", repo, 7, 0, nil},
+		{"full report expired", old, "QmPeer", repo, 7, time.Hour, nil},
+		{"timestamp mismatch", recent, "QmPeer", repo, 6, time.Hour, nil},
+		{"other peer", recent, "QmOther", repo, 7, time.Hour, nil},
+		{"other repo", recent, "QmPeer", moved, 7, time.Hour, nil},
+		{"no snapshot", recent, "QmPeer", empty, 7, time.Hour, nil},
+		{"broken snapshot", recent, "QmPeer", broken, 7, time.Hour, nil},
+	}
+	for _, test := range tests {
+		if err := saveSnapshot("QmPeer", repo, 7, test.fullTime, pinSet("QmB", "QmA")); err != nil {
+			t.Fatal(err)
+		}
+		// a snapshot copied along with the repo belongs to the old path
+		content, _ := ioutil.ReadFile(repo + "/" + snapshotFile)
+		ioutil.WriteFile(moved+"/"+snapshotFile, content, 0644)
+
+		s := loadSnapshot(test.peerID, test.path, test.timestamp, test.interval)
+		if test.want == nil {
+			if s != nil {
+				t.Errorf("%s: loadSnapshot = %v, want a full report", test.name, sortedPins(s.pinned))
+			}
+			continue
+		}
+		if s == nil {
+			t.Errorf("%s: loadSnapshot = nil, want %v", test.name, test.want)
+			continue
+		}
+		if pins := sortedPins(s.pinned); !reflect.DeepEqual(pins, test.want) || s.FullTime != test.fullTime {
+			t.Errorf("%s: loadSnapshot = %v from %d, want %v from %d", test.name, pins, s.FullTime, test.want, test.fullTime)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	defer func(size int) { PageSize = size }(PageSize)
+	PageSize = 2
+	type page struct {
+		pinned  []string
+		added   []string
+		removed []string
+		last    bool
+	}
+	tests := []struct {
+		name  string
+		base  []string
+		pages [][]string
+		want  []page
+	}{
+		{"full report", nil, [][]string{{"QmA", "QmB", "QmC"}, {"QmD"}},
+			[]page{{pinned: []string{"QmA", "QmB"}}, {pinned: []string{"QmC", "QmD"}, last: true}}},
+		{"full report of no pins", nil, [][]string{{}},
+			[]page{{last: true}}},
+		{"delta report", []string{"QmA", "QmB", "QmY", "QmX"}, [][]string{{"QmA", "QmC"}, {"QmB", "QmD"}},
+			[]page{{added: []string{"QmC", "QmD"}}, {removed: []string{"QmX", "QmY"}, last: true}}},
+		{"delta report without changes", []string{"QmA"}, [][]string{{"QmA"}},
+			[]page{{last: true}}},
+		{"delta report of removed pins only", []string{"QmA", "QmB"}, [][]string{{}},
+			[]page{{removed: []string{"QmA", "QmB"}, last: true}}},
+	}
+	ids := func(items []Item) []string {
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+	for _, test := range tests {
+		var got []page
+		p := &pager{ctx: context.Background(), send: func(ctx context.Context, request *Request) ([]byte, *Response, error) {
+			d := request.Data
+			if d.Page != len(got)+1 {
+				t.Errorf("%s: sent page %d after %d pages", test.name, d.Page, len(got))
+			}
+			var removed []string
+			if len(d.RemovedFiles) > 0 {
+				removed = d.RemovedFiles
+			}
+			got = append(got, page{ids(d.PinnedFiles), ids(d.AddedFiles), removed, d.LastPage})
+			return nil, &Response{CurrentTimestamp: 9}, nil
+		}}
+		p.reset()
+		var base *snapshot
+		if test.base != nil {
+			base = &snapshot{pinned: pinSet(test.base...)}
+		}
+		pinned := make(map[string]bool)
+		var all []string
+		for i, keys := range test.pages {
+			items := make([]Item, len(keys))
+			for j, key := range keys {
+				items[j] = Item{ID: key}
+			}
+			all = append(all, keys...)
+			if err := p.collect(base, pinned, items, i == len(test.pages)-1); err != nil {
+				t.Fatalf("%s: collect failed: %s", test.name, err)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: sent %+v, want %+v", test.name, got, test.want)
+		}
+		sort.Strings(all)
+		if pins := sortedPins(pinned); !reflect.DeepEqual(pins, all) {
+			t.Errorf("%s: collected %v, want %v", test.name, pins, all)
+		}
+		if p.response == nil || p.response.CurrentTimestamp != 9 {
+			t.Errorf("%s: response of the last page not kept", test.name)
+		}
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	repo, err := ioutil.TempDir("", "ipfs-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	full := time.Now().Add(-time.Minute).Unix()
+
+	// a full report starts a snapshot from its own time
+	if err := acknowledge("QmPeer", repo, nil, full, pinSet("QmA", "QmB"), &Response{CurrentTimestamp: 5}); err != nil {
+		t.Fatal(err)
+	}
+	base := loadSnapshot("QmPeer", repo, 5, time.Hour)
+	if base == nil || !reflect.DeepEqual(sortedPins(base.pinned), []string{"QmA", "QmB"}) || base.FullTime != full {
+		t.Fatalf("snapshot after full report = %+v, want QmA QmB from %d", base, full)
+	}
+
+	// a delta report keeps the time of the full report
+	if err := acknowledge("QmPeer", repo, base, time.Now().Unix(), pinSet("QmA", "QmC"), &Response{CurrentTimestamp: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if s := loadSnapshot("QmPeer", repo, 5, time.Hour); s != nil {
+		t.Error("snapshot still acknowledged with the old timestamp")
+	}
+	s := loadSnapshot("QmPeer", repo, 6, time.Hour)
+	if s == nil || !reflect.DeepEqual(sortedPins(s.pinned), []string{"QmA", "QmC"}) || s.FullTime != full {
+		t.Fatalf("snapshot after delta report = %+v, want QmA QmC from %d", s, full)
+	}
+
+	// full_resync makes the next report a full one
+	if err := acknowledge("QmPeer", repo, s, time.Now().Unix(), pinSet("QmA"), &Response{CurrentTimestamp: 7, FullResync: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, timestamp := range []uint64{6, 7} {
+		if s := loadSnapshot("QmPeer", repo, timestamp, time.Hour); s != nil {
+			t.Errorf("snapshot with timestamp %d kept after full_resync", timestamp)
+		}
+	}
+}
@@ -3,16 +3,24 @@ package signer
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"ipfs-monitor/command"
+	"sync"
 
 	ci "github.com/libp2p/go-libp2p-crypto"
 )
 
 //var priv *ci.PrivKey
 
+// lock guards the identity, it is loaded once the repo path of the node is
+// known, possibly after the first reports
+var lock sync.RWMutex
+
 var privatekey []byte
 
+var peerID, publicKey string
+
 type Config struct {
 	Identity Identity
 }
@@ -22,32 +30,63 @@ type Identity struct {
 	PrivKey string
 }
 
-func Initialize() {
+// Initialize loads the private key from the config file in the IPFS repo at
+// repo, reports cannot be signed before
+func Initialize(repo string) error {
 	var result Config
-	configPath, err := command.GetRepoPath()
+	content, err := ioutil.ReadFile(repo + "/config")
 	if err != nil {
-		panic("Can not get path of config file")
+		return fmt.Errorf("Can not read config file: %s", err)
 	}
-	configPath = configPath + "/config"
-	content, err := ioutil.ReadFile(configPath)
+	err = json.Unmarshal(content, &result)
 	if err != nil {
-		panic("Can not read config file")
+		return fmt.Errorf("Can not parse config file to json: %s", err)
 	}
-	err = json.Unmarshal(content, &result)
+	key, err := base64.StdEncoding.DecodeString(result.Identity.PrivKey)
 	if err != nil {
-		panic("Can not parse config file to json")
+		return fmt.Errorf("Can not decode base64 private key: %s", err)
 	}
-	privatekey, err = base64.StdEncoding.DecodeString(result.Identity.PrivKey)
+	priv, err := ci.UnmarshalPrivateKey(key)
 	if err != nil {
-		panic("Can not decode base64 private key")
+		return fmt.Errorf("Can not unmarshal private key: %s", err)
 	}
-
+	pubkey, err := ci.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return fmt.Errorf("Can not marshal public key: %s", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	privatekey = key
+	peerID = result.Identity.PeerId
+	publicKey = base64.StdEncoding.EncodeToString(pubkey)
+	return nil
 }
 
 func Sign(content string) ([]byte, error) {
-	priv, err := ci.UnmarshalPrivateKey(privatekey)
+	lock.RLock()
+	key := privatekey
+	lock.RUnlock()
+	if key == nil {
+		return nil, errors.New("Node identity is not loaded yet")
+	}
+	priv, err := ci.UnmarshalPrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
 	return priv.Sign([]byte(content))
 }
+
+// PeerID returns the peer ID of the node identity, known without asking the node
+func PeerID() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return peerID
+}
+
+// PublicKey returns the base64 encoded public key of the node identity, the
+// same as `ipfs id` reports
+func PublicKey() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return publicKey
+}
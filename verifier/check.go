@@ -0,0 +1,52 @@
+package verifier
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	ci "github.com/libp2p/go-libp2p-crypto"
+)
+
+// ErrBadSignature means the signature is well-formed but does not match the content
+var ErrBadSignature = errors.New("signature does not match content")
+
+// CheckPublicKey tells whether pubkey is a base64 encoded libp2p public key
+func CheckPublicKey(pubkey string) error {
+	_, err := publicKey(pubkey)
+	return err
+}
+
+// Check verifies a hex encoded signature of content against a base64 encoded
+// libp2p public key and tells why verification failed
+func Check(pubkey string, content string, signature string) error {
+	key, err := publicKey(pubkey)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decode signature failed: %s", err)
+	}
+	ok, err := key.Verify([]byte(content), sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func publicKey(pubkey string) (ci.PubKey, error) {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key failed: %s", err)
+	}
+	publicKey, err := ci.UnmarshalPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal public key failed: %s", err)
+	}
+	return publicKey, nil
+}